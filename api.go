@@ -0,0 +1,181 @@
+package dotenv
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A Var is a variable set by a source
+type Var struct {
+	Name, Value string
+	Source      string // description of the source that set it
+}
+
+// A SourceKind is the format of a Source
+type SourceKind string
+
+// Kinds of sources (see the corresponding command-line flags)
+const (
+	EnvFile     SourceKind = laxfile  // Python-dotenv style (the default)
+	StrictFile  SourceKind = file     // plain NAME=value lines (`-x`)
+	ShellFile   SourceKind = shell    // shell assignments (`-s`)
+	JSONFile    SourceKind = jsonfile // a JSON object or array (`--json-file`)
+	YAMLFile    SourceKind = yamlfile // a YAML map (`-y`)
+	TOMLFile    SourceKind = tomlfile // TOML (`--toml`)
+	INIFile     SourceKind = inifile  // INI or systemd EnvironmentFile (`--ini`)
+	Assignment  SourceKind = raw      // a NAME=VALUE string
+	Environment SourceKind = osenv    // this process's environment (Data is ignored)
+	Prefixed    SourceKind = prefixed // `PREFIX:data`, for `cmd:`, `git:`, or a RegisterSource prefix
+)
+
+// A Source is where variables come from: usually a file, named by Data
+type Source struct {
+	Data string
+	Kind SourceKind // "" = EnvFile
+	// Optional sources that can't be read are skipped instead of being an error
+	Optional bool
+}
+
+func (s Source) varsource() varsource {
+	kind := sourcetype(s.Kind)
+	if kind == "" {
+		kind = laxfile
+	}
+	return varsource{data: s.Data, kind: kind, explicit: !s.Optional, optional: s.Optional}
+}
+
+// Parse reads the sources, interpolating values as the command does by
+// default.  Sources are merged in the same order as on the command line:
+// assignments first, then the environment, then files, with earlier ones
+// winning within each group (but later definitions within a file).
+// Variables removed by `!NAME` are left out.
+func Parse(sources []Source) ([]Var, error) {
+	srcs := []varsource{}
+	for _, s := range sources {
+		srcs = append(srcs, s.varsource())
+	}
+	vars := []envvar{}
+	for _, src := range bypriority(srcs).sort() {
+		parsed, err := src.parse(context.Background())
+		if err != nil && src.optional {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to read %s: %v", src.describe(), err)
+		}
+		parsed, err = src.substitutevars(vars, lastdefinitions(parsed), anyinterp, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to interpolate %s: %v", src.describe(), err)
+		}
+		for i := range parsed {
+			parsed[i].from = src.describe()
+		}
+		vars = append(vars, parsed...)
+	}
+	_, vars = uniqVarsByName(vars)
+	result := []Var{}
+	for _, v := range vars {
+		if !v.tombstone {
+			result = append(result, Var{Name: v.name, Value: v.val, Source: v.from})
+		}
+	}
+	return result, nil
+}
+
+// RegisterSource adds a kind of source, named on the command line (and by
+// Sources of kind Prefixed) as `prefix:data`.  Its variables come from calling
+// parse with the data.  It panics if the prefix is empty, contains a `:`, or
+// is already registered.
+func RegisterSource(prefix string, parse func(data string) ([]Var, error)) {
+	if prefix == "" || strings.Contains(prefix, ":") {
+		panic(fmt.Sprintf("dotenv: invalid source prefix %q", prefix))
+	}
+	if _, dup := prefixsources[prefix]; dup {
+		panic(fmt.Sprintf("dotenv: source prefix %q is already registered", prefix))
+	}
+	registersource(prefix, func(ctx context.Context, data string) ([]envvar, error) {
+		parsed, err := parse(data)
+		if err != nil {
+			return nil, err
+		}
+		vars := []envvar{}
+		for _, v := range parsed {
+			vars = append(vars, envvar{name: v.Name, val: v.Value})
+		}
+		return vars, nil
+	})
+}
+
+// Read reads env files (earlier ones winning), returning their variables.
+// The environment isn't included, or modified.
+func Read(filenames ...string) (map[string]string, error) {
+	sources := []Source{}
+	for _, name := range filenames {
+		sources = append(sources, Source{Data: name})
+	}
+	vars, err := Parse(sources)
+	if err != nil {
+		return nil, err
+	}
+	env := map[string]string{}
+	for _, v := range vars {
+		env[v.Name] = v.Value
+	}
+	return env, nil
+}
+
+// Marshal formats variables as an env file, sorted by name.  Values are
+// quoted if they need to be (line breaks are escaped, if possible).
+func Marshal(vars map[string]string) (string, error) {
+	names := []string{}
+	for name := range vars {
+		if !nonstrict.MatchString(name+"=") || strings.ContainsAny(name, "#!'\"") {
+			return "", fmt.Errorf("Can't write a variable named %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out strings.Builder
+	for _, name := range names {
+		val := vars[name]
+		if strings.ContainsAny(val, "\n\r") && !strings.Contains(val, "$") {
+			val = laxdquote(val)
+		} else if strings.ContainsAny(val, " \t") {
+			val = laxquote(val)
+		} else {
+			val = laxvalue(val)
+		}
+		fmt.Fprintf(&out, "%s=%s\n", name, val)
+	}
+	return out.String(), nil
+}
+
+// Load sets the variables from env files in the current process, except for
+// those that are already set
+func Load(filenames ...string) error {
+	return setenv(filenames, false)
+}
+
+// Overload sets the variables from env files in the current process,
+// replacing any that are already set
+func Overload(filenames ...string) error {
+	return setenv(filenames, true)
+}
+
+func setenv(filenames []string, override bool) error {
+	env, err := Read(filenames...)
+	if err != nil {
+		return err
+	}
+	for name, val := range env {
+		if _, set := os.LookupEnv(name); set && !override {
+			continue
+		}
+		if err := os.Setenv(name, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
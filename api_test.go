@@ -0,0 +1,184 @@
+package dotenv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Registered by TestMain, so the command sees it, too
+func upperSource(data string) ([]Var, error) {
+	if data == "" {
+		return nil, fmt.Errorf("no names")
+	}
+	vars := []Var{}
+	for _, name := range strings.Split(data, ",") {
+		vars = append(vars, Var{Name: name, Value: strings.ToUpper(name)})
+	}
+	return vars, nil
+}
+
+func TestParse(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env": "A=a\nB=${A}/b\n!C\n",
+		"b.env": "A=ignored\nC=c\nD=d\n",
+	})
+	vars, err := Parse([]Source{
+		{Data: filepath.Join(dir, "a.env")},
+		{Data: filepath.Join(dir, "b.env"), Kind: StrictFile},
+		{Data: filepath.Join(dir, "missing.env"), Optional: true},
+		{Data: "D=raw", Kind: Assignment},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, v := range vars {
+		got = append(got, v.Name+"="+v.Value)
+	}
+	sort.Strings(got)
+	if want := []string{"A=a", "B=a/b", "D=raw"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := Parse([]Source{{Data: filepath.Join(dir, "missing.env")}}); err == nil {
+		t.Error("expected an error for a missing (required) file")
+	}
+}
+
+func TestRead(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env": "A=a\n",
+		"b.env": "A=b\nB=${A}/b\n",
+	})
+	env, err := Read(filepath.Join(dir, "a.env"), filepath.Join(dir, "b.env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// (but a file's own variables are used for its references)
+	if want := map[string]string{"A": "a", "B": "b/b"}; !reflect.DeepEqual(env, want) {
+		t.Errorf("got %q, want %q", env, want)
+	}
+	if _, err := Read(filepath.Join(dir, "missing.env")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestLoadOverload(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "DOTENV_TEST_SET=file\nDOTENV_TEST_UNSET=file\n"})
+	for _, test := range []struct {
+		name string
+		load func(...string) error
+		want string
+	}{
+		{"Load", Load, "before"},
+		{"Overload", Overload, "file"},
+	} {
+		t.Setenv("DOTENV_TEST_SET", "before")
+		t.Setenv("DOTENV_TEST_UNSET", "")
+		os.Unsetenv("DOTENV_TEST_UNSET")
+		if err := test.load(filepath.Join(dir, "a.env")); err != nil {
+			t.Fatal(err)
+		}
+		if got := os.Getenv("DOTENV_TEST_SET"); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+		if got := os.Getenv("DOTENV_TEST_UNSET"); got != "file" {
+			t.Errorf("%s: unset variable: got %q", test.name, got)
+		}
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	vars := map[string]string{
+		"EMPTY":     "",
+		"PLAIN":     "value",
+		"SPACES":    "  two  words ",
+		"HASH":      "a #not a comment",
+		"SINGLE":    "it's",
+		"DOUBLE":    `say "hi"`,
+		"BOTH":      `it's "both"`,
+		"NEWLINES":  "line 1\nline 2\r\n",
+		"DOLLAR":    "$HOME and ${HOME}",
+		"BACKSLASH": `C:\dir\n`,
+		"MIXED":     "$HOME\nnext line",
+	}
+	data, err := Marshal(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := fixtures(t, map[string]string{".env": data})
+	env, err := Read(filepath.Join(dir, ".env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(env, vars) {
+		t.Errorf("got %q, want %q from:\n%s", env, vars, data)
+	}
+	if _, err := Marshal(map[string]string{"BAD NAME": "x"}); err == nil {
+		t.Error("expected an error for an invalid name")
+	}
+}
+
+func TestRegisterSource(t *testing.T) {
+	vars, err := Parse([]Source{
+		{Data: "b=file", Kind: Assignment},
+		{Data: "test-upper:a,b", Kind: Prefixed},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Var{{"b", "file", "raw"}, {"a", "A", "test-upper:a,b"}}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("got %+v, want %+v", vars, want)
+	}
+	if _, err := Parse([]Source{{Data: "test-upper:", Kind: Prefixed}}); err == nil {
+		t.Error("expected the source's error")
+	}
+	// and on the command line
+	if got := output(t, t.TempDir(), "-u", "-o", "test-upper:x"); got != "x=X\n" {
+		t.Errorf("command line: got %q", got)
+	}
+}
+
+func TestRegisterSourceInvalid(t *testing.T) {
+	for _, prefix := range []string{"", "a:b", "cmd"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%q: expected a panic", prefix)
+				}
+			}()
+			RegisterSource(prefix, func(string) ([]Var, error) { return nil, nil })
+		}()
+	}
+}
+
+// A source backed by a secret store (here, just a map)
+func ExampleRegisterSource() {
+	secrets := map[string]string{"db": "hunter2", "api": "s3cr3t"}
+	RegisterSource("secrets", func(data string) ([]Var, error) {
+		vars := []Var{}
+		for _, name := range strings.Split(data, ",") {
+			val, ok := secrets[name]
+			if !ok {
+				return nil, fmt.Errorf("no secret named %q", name)
+			}
+			vars = append(vars, Var{Name: strings.ToUpper(name) + "_PASSWORD", Value: val})
+		}
+		return vars, nil
+	})
+	vars, err := Parse([]Source{{Data: "secrets:db,api", Kind: Prefixed}})
+	if err != nil {
+		panic(err)
+	}
+	for _, v := range vars {
+		fmt.Printf("%s=%s\n", v.Name, v.Value)
+	}
+	// Output:
+	// DB_PASSWORD=hunter2
+	// API_PASSWORD=s3cr3t
+}
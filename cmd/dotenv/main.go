@@ -0,0 +1,7 @@
+package main
+
+import "github.com/benizi/dotenv"
+
+func main() {
+	dotenv.Main()
+}
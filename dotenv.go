@@ -1,22 +1,42 @@
-package main
+// Package dotenv loads environment variables from .env files (and other
+// sources), either to run a command (see Main and cmd/dotenv) or for use by
+// other programs (see Parse, Read, and Load).
+package dotenv
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/mattn/go-shellwords"
+	"golang.org/x/term"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+	"gopkg.in/yaml.v2"
 )
 
 var (
@@ -25,21 +45,104 @@ var (
 	assignment = regexp.MustCompile(`^` + identifier + `=`)
 	getID      = regexp.MustCompile(`^(` + identifier + `)=`)
 	comment    = regexp.MustCompile(`^\s*#`)
+	unsetline  = regexp.MustCompile(`^\s*!([^\s=#!]+)\s*$`)
 	nonstrict  = regexp.MustCompile(`^[^\s=]+=`)
-	pidspec    = regexp.MustCompile(`^(?:pid|p)?:?([1-9][0-9]*)(?::(\w+))?$`)
+	pidspec    = regexp.MustCompile(`^(?:pid|p)?:?([1-9][0-9]*)(:\+children)?(?::(\w+))?$`)
 	usage      = `Usage: dotenv [options] [mode] [envs] [--] [cmd [args]]
+       dotenv run|dump|get|set ...
+
+Subcommands (alternatives to the mode flags):
+  run [envs] [--] cmd [args] = run a command (the default)
+  dump [envs] = same as '-o'
+  get [envs] [--] NAME... = same as '-p', but NAME is required
+  set [-f FILE] NAME=VALUE... = add or update assignments in FILE (default: .env)
 
 Modes:
   -o (output) / -dump = dump all
   -n (names) / -names = print names of assigned vars
   -p (values) / -vals = print values of specified vars
-
-Options:
+  --strict-values = with '-p', don't fall back to the ambient environment
+  --quiet-missing = with '-p', don't log names that weren't set (either way, they're
+                    skipped, and the exit status is 0 unless '--fail-missing' is given)
+  --fail-missing = with '-p', exit 1 if any of the names weren't set (after printing the rest)
+  --patch BASELINE = print what changed relative to the BASELINE file, as an
+                     env file ('!NAME' lines mark variables that were removed;
+                     use '-u' to leave the ambient environment out of it)
+  -c / --count = print how many variables are set (after '--prefix', '--match', etc.)
+  --diff OLD NEW = compare two files on their own (nothing else is loaded):
+                  '+ NAME=value' was added, '- NAME' was removed, and
+                  '~ NAME: old -> new' changed
+  --undefined-refs / --names-only-missing = print the names (sorted) that values refer to
+                                           but nothing defines
+  --print-duplicates = list variables set to different values by more than one
+                       source, with each source's value (highest priority first)
+  --fail-on-conflict = same, but exit 1 if there were any
+  -N / --dry-run = print the command (shell-quoted) and its environment instead of running it
+  --print-effective-config = print the settings and sources (in priority order)
+                             that would be used, then exit
+
+Options (those taking a value also accept '--option=VALUE'):
   -s / --shell = Parse files as shell scripts ('export BLAH="value"')
+  -x / --strict = Parse files as plain NAME=value lines (no quoting or interpolation,
+                  but a value that opens a '"' continues to the line that closes it)
+  -y / --yaml = Parse files as YAML maps (nested keys are flattened like JSON's)
+  --ini = Parse files as INI or systemd EnvironmentFiles ('#'/';' comments; names in a
+          '[section]' get a 'section_' prefix, using '--flatten-sep')
+  --toml = Parse files as TOML (tables are flattened like JSON objects; arrays and inline
+           tables are an error)
+  --inline-comments = Strip ' # comments' from values in strict ('-x') files
+  --trim = Remove whitespace around values in strict ('-x') files
+  --expand-escapes = Interpret '\n', '\t', '\\', etc. in values in strict ('-x') files
+                     (unknown escapes are left as-is)
   -a (alphanumeric) / --strict-vars = Only accept simple names (` + identifier + `)
   --no-sort / --unsorted = Don't sort (default: do)
   --sort / --sorted = Sort output by default
+  --sort-by-dependency = Order output so values come after any variables they reference
   -q / --quiet = Don't print errors for invalid lines
+  --warn-duplicates = Warn about names set more than once in a single source (where the
+                      last one wins)
+  --warn-summary = Print warnings together at the end, grouped by source
+  --encoding NAME = Decode subsequent files from NAME (e.g. latin1, utf-16le; BOMs are detected)
+  --file-values = In files, 'NAME=@path' sets NAME to the contents of path (relative
+                  to the file's directory; '@@' escapes a leading '@')
+  --decode-base64 = Decode values that start with '!base64:' (after interpolation), e.g.
+                    'KEY=!base64:aGVsbG8=' sets KEY to 'hello' (invalid base64 is an error)
+  --base64-marker MARKER = Decode values that start with MARKER instead (implies '--decode-base64')
+  --cmd-file FILE = Read the command (one argument per line) from FILE, before any after '--'
+  --shell-cmd-file = Split the '--cmd-file' contents like a shell would, instead of by line
+  --timeout DURATION = Kill the command if it runs longer than DURATION (e.g. '30s'),
+                       and exit 124 (like GNU timeout)
+  -C DIR / --chdir DIR = Run the command in DIR (sources are still read relative to here)
+  --drop NAME = Don't pass NAME to the command (repeatable; output modes are unaffected)
+  --stdout FILE / --stderr FILE = Redirect the command's output streams to FILE
+  --append-output = Append to those files (default: truncate)
+  --optional FILE = Load FILE if it can be read, otherwise warn and continue (bare
+                    filenames before a '--' are optional; after '-f' they're required)
+  --json-file FILE = Load a JSON object (or an array, as for '[...]') from FILE
+  --json-stdin = Load a JSON object or array from stdin (overriding all but NAME=VALUE args)
+  --from-base64 FILE = Load the output of '-b' (using the same '--base64-sep')
+  --dir-as-env DIR = Load each file in DIR as a variable named for the file (e.g. k8s volumes)
+  --array-sep SEP = Join JSON arrays of strings, numbers, and booleans with SEP (default: ',')
+  --index-arrays = Set NAME_0, NAME_1, ... for those arrays instead (always done for arrays
+                   holding objects, arrays, or nulls)
+  --flatten-sep SEP = Join nested JSON names with SEP (default: '_', so
+                      '{"DB":{"HOST":"x"}}' sets DB_HOST)
+  --strict-json = Fail on JSON values that can't be represented, instead of skipping them
+  --no-auto-json = Don't treat later '*.json' file arguments as JSON (they are by default)
+  --require NAME[,NAME...] = Fail unless each NAME is set (repeatable)
+  --interactive = Prompt for missing '--require'd variables when stdin is a
+                  terminal (input is hidden for names like *SECRET*, *TOKEN*)
+  --require-source = Fail unless at least one source (besides the environment) is loaded
+  --allow-cmd = Allow 'cmd:COMMAND ARGS' sources, which run COMMAND and read its output
+  --cmd-nul = Expect NUL-separated output from 'cmd:' sources (e.g. 'env -0')
+  --source-timeout DURATION = Treat sources that run programs ('cmd:', 'git:', PIDs via
+                              sudo) as failed if they take longer than DURATION (e.g. '10s')
+  --max-sources N = Fail if more than N sources are given (default: 1000, 0 = no limit)
+  --block N = Read only the Nth (from 0) block of the next file, split on '--block-sep' lines
+  --block-sep SEP = Line separating blocks for '--block' (default: '---')
+  --cascade ENV = Load whichever of '.env.ENV.local', '.env.local', '.env.ENV', '.env'
+                  exist (earlier ones win)
+  --auto = Load whichever of '.env.local', '.env', '.flaskenv' exist (earlier ones win)
 
 Interpolation:
   --sub / --interpolate = Enable interpolation (even when not normally default)
@@ -48,27 +151,148 @@ Interpolation:
   --reset-sub / --reset-interpolate = Fall back to default, per-source setting
   -A / --interpolate-any = Accept brackets or a limited subset of chars ('${var}' || '$Simple_vars')
   -S / --interpolate-strict = Require brackets around names to substitute ('${varname}')
+  ${VAR:-default} = 'default' if VAR is unset or empty ('${VAR:=default}' also sets VAR
+                    for later references; '${VAR:?message}' fails with message instead)
+  '$$' / '\$' = A literal '$'
+  --command-sub = Replace '$(command)' in interpolated values with the command's output
+                  (run by 'sh'; failing is an error).  Never do this with untrusted files.
+  --defer-interp = When printing, leave references unexpanded (for a shell to resolve later),
+                   along with any '$(command)' for '--command-sub'
+  --compat dotenv-expand = Interpolate like Node's dotenv-expand ('\$' escapes, '${VAR:-default}')
+  --compat python-dotenv = Parse and interpolate like python-dotenv (only '${VAR}' and
+                           '${VAR:-default}')
+  --advanced-interp = Allow transforms: '${VAR|upper}', '${VAR|lower}', '${VAR|base64}'
+                      (unknown ones are an error with '-S', otherwise a warning; a shell can't
+                      apply them, so this can't be used with '--defer-interp')
+  --name NAME = Name the next source, so '${source:NAME:VAR}' in any source gets its value
+                of VAR (even if it's overridden; an unknown NAME is an error).  Named sources
+                are interpolated on their own, before any others
+  --interp-only NAME = Only interpolate NAME's value, leaving others literal (repeatable)
+  --single-pass-interp = Only let values refer to variables defined before them (by default,
+                         references are resolved in any order, and cycles are an error)
+  --interp-no-osenv = Don't let the ambient environment satisfy references (it's
+                     still passed to the command unless '-u' is given)
+  --sub-scope sources|all = Same as '--interp-no-osenv' ('sources'), or the default ('all')
+  --interp-args = Let '${1}', '${2}', ... refer to the command's arguments ('${0}' = command)
 
 Output types:
-  -b / --base64 = Print Base64-encoded (single line, whether printing keys/vals/both)
+  -b / --base64 = Print Base64-encoded, one line per var: '{key} {val}' (dump) or
+                  just '{key}' / '{val}' (with '-n' / '-p')
+  --base64-sep SEP = Separate key and value with SEP instead of a space
   -j / --json = Print JSON map or array
+  --json-typed = With '-j', print numbers and booleans from JSON, YAML, and TOML sources
+                 as such (other values are strings)
+  -e / --export = Print "export NAME='value'" lines, quoted for a POSIX shell to eval
+                  (with '--defer-interp', values that would be interpolated are double-quoted,
+                  so the shell expands their references)
+  --fish = Print "set -gx NAME 'value'" lines, quoted for fish to eval
+  --powershell = Print "$env:NAME = 'value'" lines, quoted for PowerShell
+  --yaml-output = Print a YAML map or list
+  --json-envelope = Print JSON as {"sorted": BOOL, "count": N, "vars": MAP-OR-ARRAY}
   -0 / --nul = Print NUL-separated ( {key} \0 {val} \0 )
   -r / --raw = Print the raw value (most useful with '-p'/'--vals')
+  --args = Print one 'NAME=VALUE' argument per line (for 'xargs env'), with a backslash
+           before each blank, line break, quote, and backslash, as 'xargs' expects
+  --args0 = Print NUL-terminated 'NAME=VALUE' arguments (for 'xargs -0 env')
+  --same-format = Print in the format of the first source given, ignoring NAME=VALUE
+                  args (JSON, YAML, or Base64, else env; other output flags take precedence)
+  --dump-shell-script = Print a script for any POSIX shell to source ('set -a', quoted
+                        assignments, and 'unset' for variables removed by '!NAME')
+  --prefix PREFIX = Only print variables whose names start with PREFIX (repeatable)
+  --match GLOB = Only print variables whose names match GLOB (e.g. 'AWS_*_KEY'; repeatable,
+                 and combined with '--prefix', names must match both)
+  --strip-prefix PREFIX = Remove PREFIX from names (for output and the command), so
+                          APP_DB_URL becomes DB_URL (replacing any existing DB_URL)
+  --uppercase / --lowercase = Convert names (not values) from sources other than the
+                              environment, e.g. for lowercase JSON or YAML keys
+  --skip-empty = Leave out variables set to an empty value
+  --keep-comments = Print the comment lines that preceded each variable in its file (text dumps
+                    of '-x' and default-format files)
+  --annotate-types = Append a '# type' comment (int, float, bool, url) to text dump lines
+  --print-source = Append a '# from SOURCE' comment (a file, 'osenv', 'raw', ...) to text
+                   lines of '-o' and '-n', naming the source whose value is used
 
 Envs:
   NAME=VALUE
-  filename
+  {"NAME":VALUE,...} (a JSON object; null unsets NAME)
+  [...] (a JSON array of {"name":NAME,"value":VALUE} objects or "NAME=VALUE" strings,
+         where later entries override earlier ones; a null value or "!NAME" unsets NAME)
+  cmd:COMMAND ARGS (requires --allow-cmd)
+  git:REF:PATH (a file as of a git commit)
+  p:PID (a process's environment; 'p:PID:+children' adds all its descendants')
+  filename (a '!NAME' line in a file unsets NAME; gzipped files are decompressed)
+  -f FILE / --file FILE / --source FILE (always a file, even if named like a flag or
+                                        '--'; repeatable, with later files winning)
+  --stdin / -f - (read a file from stdin; only one source can)
 `
-	alphanumeric = false
-	sudoenv      = true
+	alphanumeric     = false
+	sudoenv          = true
+	maxsources       = 1000
+	argsubs          = false
+	deferinterp      = false
+	advancedinterp   = false
+	inlinecomments   = false
+	expandescapes    = false
+	trimvalues       = false
+	arraysep         = ","
+	flattensep       = "_"
+	base64sep        = " "
+	blocksep         = "---"
+	indexarrays      = false
+	allowcmd         = false
+	commandsub       = false
+	cmdnul           = false
+	interpnoosenv    = false
+	strictjson       = false
+	singlepassinterp = false
+	filevalues       = false
+	keepcomments     = false
+	warnduplicates   = false
+	jsontyped        = false
+	base64marker     = ""
 )
 
+// Flags that take a value (normalized to a single `-`), which is never the
+// `--` separator, and how many values they take
+var valueflags = map[string]int{}
+
+func init() {
+	for _, flag := range []string{
+		"-f", "-file", "-source", "-patch", "-encoding", "-cmd-file", "-drop",
+		"-stdout", "-stderr", "-json-file", "-array-sep", "-flatten-sep",
+		"-require", "-from-base64", "-dir-as-env", "-max-sources",
+		"-base64-sep", "-compat", "-block", "-block-sep", "-name",
+		"-interp-only", "-source-timeout", "-prefix", "-match", "-strip-prefix",
+		"-cascade", "-load-cascade", "-C", "-chdir", "-optional",
+		"-timeout", "-sub-scope", "-base64-marker",
+	} {
+		valueflags[flag] = 1
+	}
+	valueflags["-diff"] = 2
+}
+
+// Values defined by sources given a `--name`, for `${source:NAME:VAR}`
+var namedsources = map[string]map[string]string{}
+
+// If non-empty, only these variables' values are interpolated
+var interponly = map[string]bool{}
+
+// Well-known env files loaded by `--auto`, most specific first (so they win)
+var autofiles = []string{".env.local", ".env", ".flaskenv"}
+
+// Files loaded by `--cascade ENV`, highest priority first (the order Ruby
+// dotenv and Next.js use)
+func cascadefiles(env string) []string {
+	return []string{".env." + env + ".local", ".env.local", ".env." + env, ".env"}
+}
+
 // Variables for parsing Python-dotenv-style files "lax" = poorly-defined
 var (
 	laxID      = regexp.MustCompile(`^(?:[^\S\n]*export\b)?[^\S\n]*([^\s=#]+)`)
 	laxequals  = regexp.MustCompile(`^[^\S\n]*=[^\S\n]*`)
 	laxempty   = regexp.MustCompile(`^[^\S\n]*(\n|$)`)
 	laxcomment = regexp.MustCompile(`^[^\S\n]*#[^\n]*(\n|$)`)
+	laxunset   = regexp.MustCompile(`^[^\S\n]*!([^\s=#!]+)[^\S\n]*(?:\n|$)`)
 	laxtrailer = regexp.MustCompile(`^((?s:.)+?)\s+#`)
 	laxqstart  = regexp.MustCompile(`^(['"])`)
 	laxescaped = regexp.MustCompile(`\\(?s:.)`)
@@ -81,7 +305,7 @@ var (
 
 type debugging bool
 
-var debug, warn debugging
+var debug debugging
 
 func (d debugging) Printf(format string, args ...interface{}) {
 	if d {
@@ -89,17 +313,77 @@ func (d debugging) Printf(format string, args ...interface{}) {
 	}
 }
 
+// Warnings are either logged right away, or collected (grouped by the source
+// being read at the time) and logged together by `flush`
+type warnings struct {
+	enabled  bool
+	summary  bool
+	source   string
+	sources  []string
+	messages map[string][]string
+}
+
+var warn = &warnings{messages: map[string][]string{}}
+
+func (w *warnings) Printf(format string, args ...interface{}) {
+	if !w.enabled {
+		return
+	}
+	if !w.summary {
+		log.Printf(format, args...)
+		return
+	}
+	if _, seen := w.messages[w.source]; !seen {
+		w.sources = append(w.sources, w.source)
+	}
+	w.messages[w.source] = append(w.messages[w.source], fmt.Sprintf(format, args...))
+}
+
+// Exit with an error, after the warnings collected so far
+func fatal(args ...interface{}) {
+	warn.flush()
+	log.Fatal(args...)
+}
+
+func fatalf(format string, args ...interface{}) {
+	warn.flush()
+	log.Fatalf(format, args...)
+}
+
+func (w *warnings) flush() {
+	for _, source := range w.sources {
+		label := source
+		if label == "" {
+			label = "(general)"
+		}
+		log.Printf("Warnings for %s:", label)
+		for _, msg := range w.messages[source] {
+			log.Printf("  %s", msg)
+		}
+	}
+	w.sources, w.messages = nil, map[string][]string{}
+}
+
 type sourcetype string
 
 const (
-	notype  sourcetype = "notype"
-	file               = "file"
-	shell              = "shell"
-	raw                = "raw"
-	osenv              = "osenv"
-	laxfile            = "laxfile"
-	jsonmap            = "jsonmap"
-	pid                = "pid"
+	notype     sourcetype = "notype"
+	file                  = "file"
+	shell                 = "shell"
+	raw                   = "raw"
+	osenv                 = "osenv"
+	laxfile               = "laxfile"
+	jsonmap               = "jsonmap"
+	jsonarray             = "jsonarray"
+	jsonfile              = "jsonfile"
+	jsonstdin             = "jsonstdin"
+	yamlfile              = "yamlfile"
+	tomlfile              = "tomlfile"
+	inifile               = "inifile"
+	base64file            = "base64file"
+	prefixed              = "prefixed"
+	dirsource             = "dir"
+	pid                   = "pid"
 )
 
 type sublevel int
@@ -110,6 +394,18 @@ const (
 	forcesub
 )
 
+func (level sublevel) String() string {
+	switch level {
+	case neversub:
+		return "never"
+	case maybesub:
+		return "maybe"
+	case forcesub:
+		return "force"
+	}
+	return strconv.Itoa(int(level))
+}
+
 var (
 	typerankinit sync.Once
 	typerank     map[sourcetype]int
@@ -120,9 +416,13 @@ func inittyperank() {
 	typerank = map[sourcetype]int{}
 	for i, ks := range [][]sourcetype{
 		[]sourcetype{raw},
-		[]sourcetype{jsonmap},
+		[]sourcetype{jsonstdin},
+		[]sourcetype{jsonmap, jsonarray},
 		[]sourcetype{osenv},
-		[]sourcetype{file, shell, laxfile},
+		[]sourcetype{
+			file, shell, laxfile, jsonfile, yamlfile, tomlfile, inifile, prefixed,
+			dirsource, base64file,
+		},
 	} {
 		for _, k := range ks {
 			typerank[k] = i
@@ -152,13 +452,22 @@ type varsource struct {
 	kind     sourcetype
 	explicit bool
 	optional bool
+	flagged  bool // given with `-f`, so later ones win over earlier ones
 	sublevel *sublevel
+	encoding string
+	name     string
+	content  []byte
+	block    *int
 }
 
 type envvar struct {
 	name, val string
 	allowsubs bool
 	tombstone bool
+	from      string   // description of the source that set it
+	comments  []string // preceding comment lines (with `keepcomments`)
+	typed     bool     // val was a number or boolean (in JSON, YAML, or TOML)
+	line      int      // where it was set in a file (0 = not from a file)
 }
 
 func parsevar(s string) envvar {
@@ -170,7 +479,24 @@ func parsevar(s string) envvar {
 	if len(parts) > 1 {
 		val = parts[1]
 	}
-	return envvar{name, val, false, false}
+	return envvar{name: name, val: val}
+}
+
+// Short description of a source (for messages)
+func (src varsource) describe() string {
+	switch src.kind {
+	case osenv, raw, jsonmap, jsonarray, jsonstdin:
+		return string(src.kind)
+	}
+	if src.data == "-" {
+		return "stdin"
+	}
+	return src.data
+}
+
+// Location of a line in a source (for messages)
+func (src varsource) at(lineno int) string {
+	return fmt.Sprintf("%s:%d", src.describe(), lineno)
 }
 
 func (src varsource) getsublevel() sublevel {
@@ -188,7 +514,9 @@ func (src *varsource) setsublevel(level sublevel) {
 	debug.Printf("sublevel = %#+v (%v)", src.sublevel, *src.sublevel)
 }
 
-func (src varsource) parse() ([]envvar, error) {
+// Parse a source.  `ctx` bounds the sources that run other programs (see
+// `--source-timeout`); reading local files ignores it.
+func (src varsource) parse(ctx context.Context) ([]envvar, error) {
 	switch src.kind {
 	case file:
 		return src.parseFile()
@@ -202,33 +530,238 @@ func (src varsource) parse() ([]envvar, error) {
 		return src.parseOsEnviron()
 	case jsonmap:
 		return src.parseJsonMap()
+	case jsonarray:
+		return src.parseJsonArray()
+	case jsonfile:
+		return src.parseJsonFile()
+	case yamlfile:
+		return src.parseYaml()
+	case tomlfile:
+		return src.parseToml()
+	case inifile:
+		return src.parseIni()
+	case jsonstdin:
+		return src.parseJsonStdin()
 	case pid:
-		return src.parseFromPid()
+		return src.parseFromPid(ctx)
+	case prefixed:
+		return src.parsePrefixed(ctx)
+	case dirsource:
+		return src.parseDir()
+	case base64file:
+		return src.parseBase64()
 	}
 	return nil, fmt.Errorf("Unknown varsource kind: %v (data: %v)", src.kind, src.data)
 }
 
+// Look up a text encoding by name ("" = leave the bytes alone)
+func textencoding(name string) (encoding.Encoding, error) {
+	if name == "" {
+		return encoding.Nop, nil
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown encoding %q", name)
+	}
+	return enc, nil
+}
+
+var gzipmagic = []byte{0x1f, 0x8b}
+
+type decodedfile struct {
+	io.Reader
+	io.Closer
+}
+
+// Open a file source (or its in-memory `content`), decoding it to UTF-8.  A
+// UTF-16 (or UTF-8) byte-order mark overrides whatever encoding was requested.
+// Gzipped files (by the magic number, not the name) are decompressed first.
+func (src varsource) open() (io.ReadCloser, error) {
+	enc, err := textencoding(src.encoding)
+	if err != nil {
+		return nil, err
+	}
+	var file io.ReadCloser
+	if src.content != nil {
+		file = ioutil.NopCloser(bytes.NewReader(src.content))
+	} else if src.data == "-" {
+		file = ioutil.NopCloser(os.Stdin)
+	} else if file, err = os.Open(src.data); err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReader(file)
+	var reader io.Reader = buffered
+	if magic, _ := buffered.Peek(2); bytes.Equal(magic, gzipmagic) {
+		if reader, err = gzip.NewReader(reader); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Failed to decompress %s: %v", src.describe(), err)
+		}
+	}
+	decoder := unicode.BOMOverride(enc.NewDecoder())
+	return decodedfile{transform.NewReader(reader, decoder), file}, nil
+}
+
+// Longest line the line-oriented parsers will accept (certs, JSON blobs, ...)
+const maxlinesize = 16 * 1024 * 1024
+
+// Line-based parsers return whatever they read before a scanner error along
+// with the error, so optional sources can still contribute a partial parse.
+func linescanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, bufio.MaxScanTokenSize), maxlinesize)
+	scanner.Split(bufio.ScanLines)
+	return scanner
+}
+
+// A `!NAME` line means "unset NAME" (in any of the file formats)
+func unsetvar(name string) envvar {
+	return envvar{name: name, tombstone: true}
+}
+
+// Parse a strict `NAME=value` file.  Lines whose first non-blank character is
+// `#` are comments.  Everything after the `=` is the value, including any
+// ` # comment`, unless `inlinecomments` is set, and surrounding whitespace,
+// unless `trimvalues` is.  A value starting with `"` and lacking an
+// (unescaped) closing quote continues onto the following lines until one has
+// it.  Quotes and escapes are kept as-is, either way, unless
+// `expandescapes` is set (then `\n`, `\t`, `\\`, etc. are interpreted like in
+// double quotes).
 func (src varsource) parseFile() ([]envvar, error) {
 	var vars []envvar
-	file, err := os.Open(src.data)
+	file, err := src.open()
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
+	scanner := linescanner(file)
 	matcher := nonstrict
 	if alphanumeric {
 		matcher = assignment
 	}
+	var comments []string
+	lineno := 0
 	for scanner.Scan() {
+		lineno++
 		line := scanner.Text()
 		if comment.MatchString(line) {
+			if keepcomments {
+				comments = append(comments, line)
+			}
+			continue
+		}
+		if m := unsetline.FindStringSubmatch(line); m != nil && matcher.MatchString(m[1]+"=") {
+			vars = append(vars, unsetvar(m[1]))
+			comments = nil
 			continue
 		}
+		if !matcher.MatchString(line) {
+			comments = nil
+		}
 		if matcher.MatchString(line) {
-			vars = append(vars, parsevar(line))
+			v := parsevar(line)
+			v.line = lineno
+			v.comments, comments = comments, nil
+			if strings.HasPrefix(v.val, `"`) && !closesquote(v.val[1:]) {
+				name, start := v.name, lineno
+				for closed := false; !closed; {
+					if !scanner.Scan() {
+						if err := scanner.Err(); err != nil {
+							return vars, fmt.Errorf("Failed reading %s: %v", src.data, err)
+						}
+						return vars, fmt.Errorf("%s: Unclosed double-quoted value for %s", src.at(start), name)
+					}
+					lineno++
+					v.val += "\n" + scanner.Text()
+					closed = closesquote(scanner.Text())
+				}
+			}
+			if inlinecomments {
+				if trailmatch := laxtrailer.FindStringSubmatch(v.val); trailmatch != nil {
+					v.val = trailmatch[1]
+				}
+			}
+			if trimvalues {
+				v.val = strings.TrimSpace(v.val)
+			}
+			if expandescapes {
+				v.val = laxparsedq(v.val)
+			}
+			vars = append(vars, v)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return vars, fmt.Errorf("Failed reading %s: %v", src.data, err)
+	}
+	return vars, nil
+}
+
+// Whether s contains a `"` that isn't escaped by a backslash
+func closesquote(s string) bool {
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			return true
+		}
+	}
+	return false
+}
+
+var inisection = regexp.MustCompile(`^\s*\[([^\]]*)\]\s*$`)
+
+// Parse an INI file or systemd `EnvironmentFile`: `NAME = value` lines, with
+// `#` and `;` comments.  Names after a `[section]` header are prefixed with
+// `section` and `flattensep`.  Values may be wrapped in single or double
+// quotes (the latter allowing backslash escapes).
+func (src varsource) parseIni() ([]envvar, error) {
+	vars := []envvar{}
+	file, err := src.open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := linescanner(file)
+	section := ""
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
 		}
+		if m := inisection.FindStringSubmatch(line); m != nil {
+			section = strings.TrimSpace(m[1])
+			continue
+		}
+		if m := unsetline.FindStringSubmatch(line); m != nil {
+			vars = append(vars, unsetvar(m[1]))
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) < 2 || strings.TrimSpace(parts[0]) == "" {
+			warn.Printf("%s: Skipping invalid line: %s", src.at(lineno), line)
+			continue
+		}
+		name, val := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if section != "" {
+			name = section + flattensep + name
+		}
+		if len(val) >= 2 && val[0] == val[len(val)-1] {
+			switch val[0] {
+			case '"':
+				val = laxparsedq(val[1 : len(val)-1])
+			case '\'':
+				val = val[1 : len(val)-1]
+			}
+		}
+		vars = append(vars, envvar{name: name, val: val, line: lineno})
+	}
+	if err := scanner.Err(); err != nil {
+		return vars, fmt.Errorf("Failed reading %s: %v", src.data, err)
 	}
 	return vars, nil
 }
@@ -236,26 +769,33 @@ func (src varsource) parseFile() ([]envvar, error) {
 func (src varsource) parseShell() ([]envvar, error) {
 	debug.Printf("Trying Shell: %s\n", src.data)
 	var vars []envvar
-	file, err := os.Open(src.data)
+	file, err := src.open()
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 	parser := shellwords.NewParser()
-	scanner := bufio.NewScanner(file)
-	scanner.Split(bufio.ScanLines)
+	scanner := linescanner(file)
+	lineno := 0
 	for scanner.Scan() {
+		lineno++
+		start := lineno
 		line := scanner.Text()
 		if comment.MatchString(line) {
 			continue
 		}
+		if m := unsetline.FindStringSubmatch(line); m != nil {
+			vars = append(vars, unsetvar(m[1]))
+			continue
+		}
 		tokens, err := parser.Parse(line)
 		for err != nil && scanner.Scan() {
+			lineno++
 			line = line + "\n" + scanner.Text()
 			tokens, err = parser.Parse(line)
 		}
 		if err != nil {
-			debug.Printf("Skipping [%s]\n", line)
+			warn.Printf("%s: Skipping unparseable line: %s", src.at(start), strings.SplitN(line, "\n", 2)[0])
 			continue
 		}
 		if len(tokens) > 0 && tokens[0] == "export" {
@@ -265,7 +805,9 @@ func (src varsource) parseShell() ([]envvar, error) {
 			continue
 		}
 		if assignment.MatchString(tokens[0]) {
-			vars = append(vars, parsevar(tokens[0]))
+			v := parsevar(tokens[0])
+			v.line = start
+			vars = append(vars, v)
 		} else if name.MatchString(tokens[0]) && len(tokens) > 1 {
 			key := tokens[0]
 			val := tokens[1]
@@ -274,12 +816,15 @@ func (src varsource) parseShell() ([]envvar, error) {
 			} else {
 				debug.Printf("TODO: %q\n", tokens)
 			}
-			vars = append(vars, envvar{key, val, true, false})
+			vars = append(vars, envvar{name: key, val: val, allowsubs: true, line: start})
 		} else {
 			debug.Printf("TODO: %q\n", tokens)
 			continue
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		return vars, fmt.Errorf("Failed reading %s: %v", src.data, err)
+	}
 	return vars, nil
 }
 
@@ -352,25 +897,66 @@ func laxparsedq(s string) string {
 	return laxescaped.ReplaceAllStringFunc(s, laxsubdq)
 }
 
+// Select block `n` of a multi-document stream, where blocks are separated by
+// lines consisting of `blocksep`
+func selectblock(data string, n int) (string, error) {
+	blocks := []string{""}
+	for _, line := range strings.SplitAfter(data, "\n") {
+		if strings.TrimSpace(line) == blocksep {
+			blocks = append(blocks, "")
+			continue
+		}
+		blocks[len(blocks)-1] += line
+	}
+	if n >= len(blocks) {
+		return "", fmt.Errorf("Block %d requested, but only %d found", n, len(blocks))
+	}
+	return blocks[n], nil
+}
+
 // Parse a Python-dotenv style file (allows some quoting, interpolation)
 func (src varsource) parseLax() ([]envvar, error) {
 	vars := []envvar{}
-	rawdata, err := ioutil.ReadFile(src.data)
+	file, err := src.open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	rawdata, err := ioutil.ReadAll(file)
 	if err != nil {
 		return nil, err
 	}
 	data := string(rawdata)
+	var comments []string
+	if src.block != nil {
+		if data, err = selectblock(data, *src.block); err != nil {
+			return nil, err
+		}
+	}
+	// Line numbers (for messages) are counted from what's been consumed
+	lineno, consumed, whole := 1, 0, data
 	for len(data) > 0 {
+		lineno += strings.Count(whole[consumed:len(whole)-len(data)], "\n")
+		consumed = len(whole) - len(data)
 		debug.Printf("")
 		debug.Printf("PARSING %q", dbglines(data))
 		lines := strings.SplitN(data, "\n", 2)
 		line := lines[0]
 		if trimRegex(&data, laxcomment) {
 			debug.Printf("  COMMENT[%s]", line)
+			if keepcomments {
+				comments = append(comments, line)
+			}
 			continue
 		}
 		if trimRegex(&data, laxempty) {
 			debug.Printf("  EMPTYLINE[%q]", line)
+			comments = nil
+			continue
+		}
+		if unset, m := trimRegexMatches(&data, laxunset); unset {
+			debug.Printf("  UNSET[%s]", m[1])
+			vars = append(vars, unsetvar(m[1]))
 			continue
 		}
 		hasID, idmatch := trimRegexMatches(&data, laxID)
@@ -383,8 +969,15 @@ func (src varsource) parseLax() ([]envvar, error) {
 			switch {
 			case trimRegex(&data, laxcomment):
 				debug.Printf("EMPTYCOMM[%s]", line)
+				if compat == pythondotenv {
+					// python-dotenv parses these as `None`, which isn't set
+					continue
+				}
 			case trimRegex(&data, laxempty):
 				debug.Printf("EMPTYVAL[%s]", line)
+				if compat == pythondotenv {
+					continue
+				}
 			case trimRegex(&data, laxequals):
 				debug.Printf("  HASEQ remaining:[%q]", dbglines(data))
 				hasQ, qmatch := trimRegexMatches(&data, laxqstart)
@@ -397,7 +990,7 @@ func (src varsource) parseLax() ([]envvar, error) {
 					hasMatch, qvals := trimRegexMatches(&data, qmatcher)
 					if !hasMatch {
 						debug.Printf("Unclosed %s-quoted value [%q]", qkind, data)
-						return nil, fmt.Errorf("Unclosed %s-quoted value", qkind)
+						return vars, fmt.Errorf("%s: Unclosed %s-quoted value for %s", src.at(lineno), qkind, name)
 					}
 					val = unquoter(qvals[1])
 					debug.Printf("%s-QUOTED RAW[%q] VAL[%q]", strings.ToUpper(qkind), qvals[1], val)
@@ -409,7 +1002,7 @@ func (src varsource) parseLax() ([]envvar, error) {
 				} else {
 					toend, lvals := trimRegexMatches(&data, laxdiscard)
 					if !toend {
-						return nil, fmt.Errorf("Couldn't read to end [%q]", data)
+						return vars, fmt.Errorf("%s: Couldn't read to end [%q]", src.at(lineno), data)
 					}
 					val = strings.TrimSpace(lvals[1])
 					trailmatch := laxtrailer.FindStringSubmatch(val)
@@ -419,17 +1012,19 @@ func (src varsource) parseLax() ([]envvar, error) {
 					debug.Printf("SIMPLEVAL[%q]", val)
 				}
 			default:
-				warn.Printf("Invalid line (%q)", line)
+				warn.Printf("%s: Invalid line (%q)", src.at(lineno), line)
 				debug.Printf("FIXME")
 				trimRegex(&data, laxdiscard)
 				continue
 			}
 		default:
-			warn.Printf("Invalid line (%q)", line)
+			warn.Printf("%s: Invalid line (%q)", src.at(lineno), line)
 			trimRegex(&data, laxdiscard)
 			continue
 		}
-		vars = append(vars, envvar{name, val, allowsubs, false})
+		v := envvar{name: name, val: val, allowsubs: allowsubs, comments: comments, line: lineno}
+		vars = append(vars, v)
+		comments = nil
 	}
 	return vars, nil
 }
@@ -443,225 +1038,1760 @@ func (src varsource) parseOsEnviron() ([]envvar, error) {
 }
 
 func (src varsource) parseJsonMap() ([]envvar, error) {
-	vars := []envvar{}
-	var env map[string]interface{}
-	err := json.Unmarshal([]byte(src.data), &env)
+	vars, err := parseJson([]byte(src.data))
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse JSON [%q]: %v", src.data, err)
 	}
-	for k, rawv := range env {
-		out := envvar{name: k}
-		switch v := rawv.(type) {
-		case nil:
-			out.tombstone = true
-		case string:
-			out.val = v
-		case int:
-			out.val = string(v)
-		}
-		vars = append(vars, out)
-	}
 	return vars, nil
 }
 
-func (src varsource) parseFromPid() ([]envvar, error) {
-	vars := []envvar{}
-	include := map[string]bool{}
-	fmterr := func(msg string) error {
-		return fmt.Errorf("Failed to parse pid spec [%q]: %s", src.data, msg)
-	}
-	parts := pidspec.FindStringSubmatch(src.data)
-	if parts == nil {
-		return nil, fmterr("didn't match regexp")
-	}
-	// Skip full match
-	parts = parts[1:]
-	names := parts[1]
-	sep := ","
-	if len(names) > 1 && names[1] == ':' {
-		sep, names = names[0:1], names[2:]
+// Parse a JSON array of `{"name":NAME,"value":VALUE}` objects or `"NAME=VALUE"`
+// strings.  Later entries override earlier ones (a null value, or a `"!NAME"`
+// string, unsets NAME), as in any other source.
+func (src varsource) parseJsonArray() ([]envvar, error) {
+	var parsed []interface{}
+	decoder := json.NewDecoder(strings.NewReader(src.data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, fmt.Errorf("Failed to parse JSON [%q]: %v", src.data, err)
 	}
-	for _, v := range strings.Split(names, sep) {
-		if v != "" {
-			include[v] = true
+	return jsonarrayvars(parsed)
+}
+
+// The variables set by the elements of a JSON array (see `parseJsonArray`)
+func jsonarrayvars(parsed []interface{}) ([]envvar, error) {
+	all := []envvar{}
+	for i, elem := range parsed {
+		switch e := elem.(type) {
+		case string:
+			if m := unsetline.FindStringSubmatch(e); m != nil {
+				all = append(all, unsetvar(m[1]))
+			} else {
+				all = append(all, parsevar(e))
+			}
+		case map[string]interface{}:
+			name, ok := e["name"].(string)
+			if !ok || name == "" {
+				return nil, fmt.Errorf("JSON array element %d has no \"name\"", i)
+			}
+			value, ok := e["value"]
+			if !ok {
+				return nil, fmt.Errorf("JSON array element %d (%s) has no \"value\"", i, name)
+			}
+			flattened, err := flattenjson(name, value)
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, flattened...)
+		default:
+			return nil, fmt.Errorf("JSON array element %d is %s, not an object or string", i, jsontype(elem))
 		}
 	}
-	p, err := strconv.ParseUint(parts[0], 10, 32)
+	return lastdefinitions(all), nil
+}
+
+func (src varsource) parseJsonFile() ([]envvar, error) {
+	file, err := src.open()
 	if err != nil {
-		return nil, fmterr(fmt.Sprintf("couldn't parse PID %v", err))
+		return nil, err
 	}
-	allvars, err := readenv(p)
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
 	if err != nil {
-		return nil, fmterr(fmt.Sprintf("couldn't read PID %d env vars %v", p, err))
+		return nil, err
 	}
-	for _, v := range allvars {
-		if len(include) > 0 && !include[v.name] {
-			continue
-		}
-		vars = append(vars, v)
+	vars, err := parseJson(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse JSON file %s: %v", src.data, err)
 	}
 	return vars, nil
 }
 
-func readenv(p uint64) ([]envvar, error) {
-	proc, err := os.Stat("/proc")
+func (src varsource) parseJsonStdin() ([]envvar, error) {
+	data, err := ioutil.ReadAll(os.Stdin)
 	if err != nil {
 		return nil, err
 	}
-	if !proc.IsDir() {
-		return nil, fmt.Errorf("/proc is not a directory")
-	}
-	environ := fmt.Sprintf("/proc/%d/environ", p)
-	data, err := ioutil.ReadFile(environ)
+	vars, err := parseJson(data)
 	if err != nil {
-		if os.Geteuid() <= 0 || !sudoenv {
-			return nil, err
-		}
-		ret := err
-		data, err = exec.Command("sudo", "cat", environ).Output()
-		if err != nil {
-			return nil, ret
-		}
-	}
-	vars := []envvar{}
-	matcher := nonstrict
-	if alphanumeric {
-		matcher = assignment
-	}
-	for _, v := range strings.Split(string(data), "\x00") {
-		if matcher.MatchString(v) {
-			vars = append(vars, parsevar(v))
-		}
+		return nil, fmt.Errorf("Failed to parse JSON from stdin: %v", err)
 	}
 	return vars, nil
 }
 
-func (src varsource) substitutevars(env, raw []envvar, varmatch *regexp.Regexp) []envvar {
-	parsed := []envvar{}
-	vals := map[string]string{}
-	level := src.getsublevel()
-	if level != src.kind.defaultsub() {
-		for i, _ := range raw {
-			raw[i].allowsubs = level != neversub
-		}
-	}
-	// Include original env vars, even if they're being cleared
-	for _, v := range os.Environ() {
-		e := parsevar(v)
-		vals[e.name] = e.val
+func parseJson(data []byte) ([]envvar, error) {
+	var parsed interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, err
 	}
-	for _, v := range env {
-		vals[v.name] = v.val
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("Unexpected data after the JSON value")
 	}
-	for _, r := range raw {
-		subbed := r.val
-		if r.allowsubs {
-			subbed = varmatch.ReplaceAllStringFunc(subbed, func(s string) string {
-				parts := varmatch.FindStringSubmatch(s)
-				if len(parts) > 1 {
-					name := parts[1]
-					if name == "" && len(parts) > 2 {
-						name = parts[2]
-					}
-					if val, ok := vals[name]; ok {
-						return val
-					}
-				}
-				return ""
-			})
-		}
-		vals[r.name] = subbed
-		parsed = append(parsed, envvar{r.name, subbed, r.allowsubs, r.tombstone})
+	switch env := parsed.(type) {
+	case map[string]interface{}:
+		return flattenjson("", env)
+	case []interface{}:
+		return jsonarrayvars(env)
 	}
-	return parsed
+	return nil, fmt.Errorf("Expected a JSON object or array, not %s", jsontype(parsed))
 }
 
-type priority struct {
-	source varsource
-	pos    int
-}
-
-type prioritysort struct {
-	sources []priority
+// Name of a JSON value's type (for messages)
+func jsontype(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "a string"
+	case json.Number:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case []interface{}:
+		return "an array"
+	case map[string]interface{}:
+		return "an object"
+	}
+	return fmt.Sprintf("%T", v)
 }
 
-func (p *prioritysort) Len() int {
-	return len(p.sources)
-}
-func (p *prioritysort) Swap(i, j int) {
-	p.sources[i], p.sources[j] = p.sources[j], p.sources[i]
-}
-func (p *prioritysort) Less(i, j int) bool {
-	a, b := p.sources[i], p.sources[j]
-	ka, kb := a.source.kind, b.source.kind
-	ra, rb := ka.rank(), kb.rank()
-	pa, pb := a.pos, b.pos
-	switch {
-	case ra != rb:
-		return ra < rb
+// Flatten a JSON value into variables.  Nested object keys and array indexes
+// are appended to the parent's name after `flattensep` (`{"A":{"B":1}}` sets
+// `A_B`).  Arrays of scalars (strings, numbers, and booleans, in any mix) are
+// joined with `arraysep` instead, unless `indexarrays` is set, so an array's
+// naming only depends on whether it holds objects, arrays, or nulls.  Other
+// values are skipped, or are an error if `strictjson` is set.
+func flattenjson(name string, rawv interface{}) ([]envvar, error) {
+	vars := []envvar{}
+	child := func(key string) string {
+		if name == "" {
+			return key
+		}
+		return name + flattensep + key
 	}
-	return pa < pb
+	switch v := rawv.(type) {
+	case nil:
+		vars = append(vars, envvar{name: name, tombstone: true})
+	case string:
+		vars = append(vars, envvar{name: name, val: v})
+	case json.Number:
+		vars = append(vars, envvar{name: name, val: jsonnumber(v), typed: true})
+	case bool:
+		vars = append(vars, envvar{name: name, val: strconv.FormatBool(v), typed: true})
+	case map[string]interface{}:
+		keys := []string{}
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			flattened, err := flattenjson(child(k), v[k])
+			if err != nil {
+				return nil, err
+			}
+			vars = append(vars, flattened...)
+		}
+	case []interface{}:
+		if !indexarrays && allscalars(v) {
+			vars = append(vars, envvar{name: name, val: joinarray(v)})
+			break
+		}
+		for i, elem := range v {
+			flattened, err := flattenjson(child(strconv.Itoa(i)), elem)
+			if err != nil {
+				return nil, err
+			}
+			vars = append(vars, flattened...)
+		}
+	default:
+		if strictjson {
+			return nil, fmt.Errorf("Unsupported value for %s: %s", name, jsontype(v))
+		}
+	}
+	return vars, nil
 }
 
-func (p *prioritysort) sort() []varsource {
-	sort.Sort(p)
-	ret := []varsource{}
-	for _, i := range p.sources {
-		ret = append(ret, i.source)
+// Format a JSON number the way it was probably meant: integers (even huge
+// ones) as written, integral floats without a fraction, and other floats in
+// their shortest form
+func jsonnumber(n json.Number) string {
+	s := n.String()
+	if jsoninteger.MatchString(s) {
+		return s
 	}
-	return ret
+	f, err := n.Float64()
+	if err != nil {
+		return s
+	}
+	if f == math.Trunc(f) && math.Abs(f) < 1e21 {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
 }
 
-func bypriority(sources []varsource) *prioritysort {
-	p := &prioritysort{}
+var jsoninteger = regexp.MustCompile(`^-?[0-9]+$`)
+
+// Parse a YAML file containing a top-level map.  Values are converted like
+// JSON values are, including nested maps and lists, which are flattened with
+// `flattensep` (so `DB: {HOST: x}` sets `DB_HOST`).
+func (src varsource) parseYaml() ([]envvar, error) {
+	file, err := src.open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	var parsed interface{}
+	if err := yaml.Unmarshal(data, &parsed); err != nil {
+		return nil, fmt.Errorf("Failed to parse YAML file %s: %v", src.data, err)
+	}
+	if parsed == nil {
+		// empty document
+		return []envvar{}, nil
+	}
+	env, ok := yamltojson(parsed).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Failed to parse YAML file %s: Expected a map, not %s",
+			src.data, jsontype(yamltojson(parsed)))
+	}
+	vars, err := flattenjson("", env)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse YAML file %s: %v", src.data, err)
+	}
+	return vars, nil
+}
+
+// Convert a decoded YAML value to the types `flattenjson` expects
+func yamltojson(rawv interface{}) interface{} {
+	switch v := rawv.(type) {
+	case nil, string, bool:
+		return v
+	case int:
+		return json.Number(strconv.Itoa(v))
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10))
+	case uint64:
+		return json.Number(strconv.FormatUint(v, 10))
+	case float64:
+		return json.Number(strconv.FormatFloat(v, 'g', -1, 64))
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, elem := range v {
+			m[fmt.Sprint(k)] = yamltojson(elem)
+		}
+		return m
+	case []interface{}:
+		l := []interface{}{}
+		for _, elem := range v {
+			l = append(l, yamltojson(elem))
+		}
+		return l
+	}
+	return fmt.Sprint(rawv)
+}
+
+// Parse a TOML file.  Keys in tables are flattened with `flattensep` (so
+// `[db] host = "x"` sets `db_host`).  Arrays and inline tables are an error.
+func (src varsource) parseToml() ([]envvar, error) {
+	file, err := src.open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	var parsed map[string]interface{}
+	if _, err := toml.Decode(string(data), &parsed); err != nil {
+		return nil, fmt.Errorf("Failed to parse TOML file %s: %v", src.data, err)
+	}
+	if line := tomlinlinetable(string(data)); line > 0 {
+		return nil, fmt.Errorf("Failed to parse TOML file %s: Unsupported inline table on line %d",
+			src.data, line)
+	}
+	env, err := tomltojson("", parsed)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse TOML file %s: %v", src.data, err)
+	}
+	return flattenjson("", env)
+}
+
+// The line of the first inline table in a (valid) TOML document, or 0 if
+// there are none.  Once decoded, they look like any other table, but outside
+// of strings and comments, a `{` can only start one.
+func tomlinlinetable(doc string) int {
+	line := 1
+	for i := 0; i < len(doc); i++ {
+		switch c := doc[i]; c {
+		case '\n':
+			line++
+		case '{':
+			return line
+		case '#':
+			for i+1 < len(doc) && doc[i+1] != '\n' {
+				i++
+			}
+		case '"', '\'':
+			quote := doc[i : i+1]
+			if strings.HasPrefix(doc[i:], strings.Repeat(quote, 3)) {
+				quote = strings.Repeat(quote, 3)
+			}
+			i += len(quote)
+			for i < len(doc) && !strings.HasPrefix(doc[i:], quote) {
+				if doc[i] == '\\' && c == '"' {
+					i++
+				}
+				if i < len(doc) && doc[i] == '\n' {
+					line++
+				}
+				i++
+			}
+			i += len(quote) - 1
+			// (a multi-line string can end with one or two more quotes)
+			for len(quote) == 3 && i+1 < len(doc) && doc[i+1] == c {
+				i++
+			}
+		}
+	}
+	return 0
+}
+
+// Convert a decoded TOML value to the types `flattenjson` expects
+func tomltojson(key string, rawv interface{}) (interface{}, error) {
+	switch v := rawv.(type) {
+	case string, bool:
+		return v, nil
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10)), nil
+	case float64:
+		return json.Number(strconv.FormatFloat(v, 'g', -1, 64)), nil
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, elem := range v {
+			path := k
+			if key != "" {
+				path = key + "." + k
+			}
+			converted, err := tomltojson(path, elem)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = converted
+		}
+		return m, nil
+	case time.Time:
+		// local dates and times are marked with special locations
+		switch v.Location().String() {
+		case "date-local":
+			return v.Format("2006-01-02"), nil
+		case "time-local":
+			return v.Format("15:04:05.999999999"), nil
+		case "datetime-local":
+			return v.Format("2006-01-02T15:04:05.999999999"), nil
+		}
+		return v.Format(time.RFC3339Nano), nil
+	case []interface{}, []map[string]interface{}:
+		return nil, fmt.Errorf("Unsupported array value for %s", key)
+	}
+	return fmt.Sprint(rawv), nil
+}
+
+// Whether a JSON array holds only strings, numbers, and booleans
+func allscalars(vals []interface{}) bool {
+	for _, rawv := range vals {
+		switch rawv.(type) {
+		case string, json.Number, bool:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Join the (scalar) elements of a JSON array with `arraysep`
+func joinarray(vals []interface{}) string {
+	parts := []string{}
+	for _, rawv := range vals {
+		switch v := rawv.(type) {
+		case string:
+			parts = append(parts, v)
+		case json.Number:
+			parts = append(parts, jsonnumber(v))
+		case bool:
+			parts = append(parts, strconv.FormatBool(v))
+		}
+	}
+	return strings.Join(parts, arraysep)
+}
+
+const base64chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/="
+
+// Read the output of `dotenv -b` (`{key}{base64sep}{val}` lines) back in
+func (src varsource) parseBase64() ([]envvar, error) {
+	file, err := src.open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	vars := []envvar{}
+	scanner := linescanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, base64sep, 2)
+		if len(fields) != 2 {
+			return vars, fmt.Errorf("%s: expected two Base64 fields", src.at(lineno))
+		}
+		decoded := []string{}
+		for _, f := range fields {
+			b, err := base64.StdEncoding.DecodeString(f)
+			if err != nil {
+				return vars, fmt.Errorf("%s: %v", src.at(lineno), err)
+			}
+			decoded = append(decoded, string(b))
+		}
+		vars = append(vars, envvar{name: decoded[0], val: decoded[1], line: lineno})
+	}
+	if err := scanner.Err(); err != nil {
+		return vars, fmt.Errorf("Failed reading %s: %v", src.data, err)
+	}
+	return vars, nil
+}
+
+// Read a directory of files named for the variables they contain (as with
+// Kubernetes Secret and ConfigMap volumes).  Dotfiles and anything that isn't
+// (or doesn't link to) a regular file are skipped.  One trailing newline is
+// removed from each value.
+func (src varsource) parseDir() ([]envvar, error) {
+	entries, err := ioutil.ReadDir(src.data)
+	if err != nil {
+		return nil, err
+	}
+	matcher := nonstrict
+	if alphanumeric {
+		matcher = assignment
+	}
+	vars := []envvar{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !matcher.MatchString(name+"=") {
+			continue
+		}
+		path := filepath.Join(src.data, name)
+		if !isfile(path) {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		vars = append(vars, envvar{name: name, val: strings.TrimSuffix(string(data), "\n")})
+	}
+	return vars, nil
+}
+
+// With `filevalues`, replace `@path` values in a file with the contents of
+// `path` (relative to the file's directory).  `@@` at the start is a literal
+// `@`.  Unreadable files are an error for explicit sources, and otherwise
+// leave the variable unset.
+func (src varsource) readfilevalues(vars []envvar) ([]envvar, error) {
+	switch src.kind {
+	case file, shell, laxfile:
+	default:
+		return vars, nil
+	}
+	dir := filepath.Dir(src.data)
+	read := []envvar{}
+	for _, v := range vars {
+		if strings.HasPrefix(v.val, "@@") {
+			v.val = v.val[1:]
+		} else if strings.HasPrefix(v.val, "@") && !v.tombstone {
+			path := v.val[1:]
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil && src.explicit {
+				return nil, fmt.Errorf("%s: %v", v.name, err)
+			} else if err != nil {
+				warn.Printf("Skipping %s: %v", v.name, err)
+				continue
+			}
+			v.val = strings.TrimSuffix(string(data), "\n")
+		}
+		read = append(read, v)
+	}
+	return read, nil
+}
+
+// Decode values that start with `base64marker` (`NAME=!base64:aGVsbG8=` sets
+// NAME to `hello`)
+func decodebase64values(vars []envvar) ([]envvar, error) {
+	for i, v := range vars {
+		if !strings.HasPrefix(v.val, base64marker) || v.tombstone {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(v.val[len(base64marker):])
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid base64: %v", v.name, err)
+		}
+		vars[i].val = string(decoded)
+	}
+	return vars, nil
+}
+
+// Parsers for `PREFIX:data` sources, keyed by PREFIX
+var prefixsources = map[string]func(ctx context.Context, data string) ([]envvar, error){}
+
+// Add a kind of source, given on the command line as `prefix:data`
+func registersource(prefix string,
+	parser func(ctx context.Context, data string) ([]envvar, error)) {
+	prefixsources[prefix] = parser
+}
+
+// The registered prefix of an argument ("" if it doesn't have one)
+func sourceprefix(arg string) string {
+	if i := strings.Index(arg, ":"); i > 0 {
+		if _, ok := prefixsources[arg[:i]]; ok {
+			return arg[:i]
+		}
+	}
+	return ""
+}
+
+func (src varsource) parsePrefixed(ctx context.Context) ([]envvar, error) {
+	prefix := sourceprefix(src.data)
+	if prefix == "" {
+		return nil, fmt.Errorf("No source registered for %q", src.data)
+	}
+	return prefixsources[prefix](ctx, src.data[len(prefix)+1:])
+}
+
+func (src varsource) parseFromPid(ctx context.Context) ([]envvar, error) {
+	vars := []envvar{}
+	include := map[string]bool{}
+	fmterr := func(msg string) error {
+		return fmt.Errorf("Failed to parse pid spec [%q]: %s", src.data, msg)
+	}
+	parts := pidspec.FindStringSubmatch(src.data)
+	if parts == nil {
+		return nil, fmterr("didn't match regexp")
+	}
+	// Skip full match
+	parts = parts[1:]
+	children := parts[1] != ""
+	names := parts[2]
+	sep := ","
+	if len(names) > 1 && names[1] == ':' {
+		sep, names = names[0:1], names[2:]
+	}
+	for _, v := range strings.Split(names, sep) {
+		if v != "" {
+			include[v] = true
+		}
+	}
+	p, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return nil, fmterr(fmt.Sprintf("couldn't parse PID %v", err))
+	}
+	allvars, err := readenv(ctx, p)
+	if err != nil {
+		return nil, fmterr(fmt.Sprintf("couldn't read PID %d env vars %v", p, err))
+	}
+	if children {
+		descendants, err := descendants(ctx, p)
+		if err != nil {
+			return nil, fmterr(fmt.Sprintf("couldn't list children of PID %d: %v", p, err))
+		}
+		for _, child := range descendants {
+			childvars, err := readenv(ctx, child)
+			if perr, ok := err.(*os.PathError); os.IsNotExist(err) || ok && perr.Err == syscall.ESRCH {
+				// exited since the process list was read
+				continue
+			} else if errors.Is(err, os.ErrPermission) {
+				// e.g. run by another user (via `sudo`, or a setuid program)
+				warn.Printf("Skipping PID %d (a descendant of %d): %v", child, p, err)
+				continue
+			} else if err != nil {
+				return nil, fmterr(fmt.Sprintf("couldn't read PID %d env vars %v", child, err))
+			}
+			allvars = append(allvars, childvars...)
+		}
+	}
+	for _, v := range allvars {
+		if len(include) > 0 && !include[v.name] {
+			continue
+		}
+		vars = append(vars, v)
+	}
+	return vars, nil
+}
+
+// List the descendants of a process, breadth-first
+func descendants(ctx context.Context, p uint64) ([]uint64, error) {
+	children, err := childpids(ctx)
+	if err != nil {
+		return nil, err
+	}
+	found := []uint64{}
+	for queue := children[p]; len(queue) > 0; queue = queue[1:] {
+		found = append(found, queue[0])
+		queue = append(queue, children[queue[0]]...)
+	}
+	return found, nil
+}
+
+// Parse `NAME=value` entries separated by `sep` (skipping anything else)
+func parseassignments(data, sep string) []envvar {
+	vars := []envvar{}
+	matcher := nonstrict
+	if alphanumeric {
+		matcher = assignment
+	}
+	for _, v := range strings.Split(data, sep) {
+		if matcher.MatchString(v) {
+			vars = append(vars, parsevar(v))
+		}
+	}
+	return vars
+}
+
+func init() {
+	registersource("cmd", parseCommandOutput)
+	registersource("git", parseGitBlob)
+}
+
+// Read a file from git without checking it out (`REF:path/to/.env`)
+func parseGitBlob(ctx context.Context, data string) ([]envvar, error) {
+	blob, err := exec.CommandContext(ctx, "git", "cat-file", "blob", data).Output()
+	if err != nil {
+		if exit, ok := err.(*exec.ExitError); ok && len(exit.Stderr) > 0 {
+			err = fmt.Errorf("%s", strings.TrimSpace(string(exit.Stderr)))
+		}
+		return nil, fmt.Errorf("Failed to read %s from git: %v", data, err)
+	}
+	src := varsource{kind: laxfile, data: "git:" + data, content: blob}
+	if strings.EqualFold(filepath.Ext(data), ".json") {
+		src.kind = jsonfile
+	}
+	return src.parse(ctx)
+}
+
+// Run a command (split like a shell would, but not run by one), and parse
+// its output as `NAME=value` lines (or NUL-separated entries, with `cmdnul`)
+func parseCommandOutput(ctx context.Context, data string) ([]envvar, error) {
+	if !allowcmd {
+		return nil, fmt.Errorf("Refusing to run %q: `cmd:` sources require --allow-cmd", data)
+	}
+	words, err := shellwords.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("No command given")
+	}
+	proc := exec.CommandContext(ctx, words[0], words[1:]...)
+	proc.Stderr = os.Stderr
+	out, err := proc.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Command %q failed: %v", data, err)
+	}
+	sep := "\n"
+	if cmdnul {
+		sep = "\x00"
+	}
+	return parseassignments(string(out), sep), nil
+}
+
+// Name referenced by an interpolation match (`${name}` or `$name`)
+func refname(varmatch *regexp.Regexp, s string) string {
+	parts := varmatch.FindStringSubmatch(s)
+	if len(parts) > 1 {
+		name := parts[1]
+		if name == "" && len(parts) > 2 {
+			name = parts[2]
+		}
+		return name
+	}
+	return ""
+}
+
+// Names of all variables referenced by a value (escaped `$`s aren't
+// references, and `${VAR|func}` refers to VAR with `advancedinterp`)
+func references(val string, varmatch *regexp.Regexp) []string {
+	refs := []string{}
+	for _, s := range varmatch.FindAllString(interpescapes.Replace(val), -1) {
+		ref := refname(varmatch, s)
+		if advancedinterp {
+			ref = strings.SplitN(ref, "|", 2)[0]
+		}
+		if name, _, _ := splitexpansion(ref); name != "" {
+			refs = append(refs, name)
+		}
+	}
+	return refs
+}
+
+// Reorder vars so that each one comes after any others its value references
+// (otherwise keeping the original order).  Returns an error on cycles.
+func depsort(vars []envvar, varmatch *regexp.Regexp) ([]envvar, error) {
+	pending := map[string]bool{}
+	for _, v := range vars {
+		pending[v.name] = true
+	}
+	sorted := []envvar{}
+	remaining := vars
+	for len(remaining) > 0 {
+		blocked := []envvar{}
+		for _, v := range remaining {
+			ready := true
+			for _, ref := range references(v.val, varmatch) {
+				if ref != v.name && pending[ref] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				sorted = append(sorted, v)
+				delete(pending, v.name)
+			} else {
+				blocked = append(blocked, v)
+			}
+		}
+		if len(blocked) == len(remaining) {
+			names := []string{}
+			for _, v := range blocked {
+				names = append(names, v.name)
+			}
+			return vars, fmt.Errorf("Dependency cycle among: %s", strings.Join(names, ", "))
+		}
+		remaining = blocked
+	}
+	return sorted, nil
+}
+
+// Mark which values are interpolated, per the source's sublevel and
+// `interponly`
+func (src varsource) marksubs(raw []envvar) {
+	level := src.getsublevel()
+	for i := range raw {
+		if level != src.kind.defaultsub() {
+			raw[i].allowsubs = level != neversub
+		}
+		if len(interponly) > 0 && !interponly[raw[i].name] {
+			raw[i].allowsubs = false
+		}
+	}
+}
+
+// Interpolate values (when allowed) using the vars seen so far.  If `argsubs`
+// is set, numeric names refer to `args` (the command to be run) instead, and
+// `source:NAME:VAR` refers to VAR as defined by the source named NAME.  If
+// `deferinterp` is set, values are left as-is (see `checkdeferred`).
+func (src varsource) substitutevars(env, raw []envvar, varmatch *regexp.Regexp,
+	args []string) ([]envvar, error) {
+	parsed := []envvar{}
+	vals := map[string]string{}
+	src.marksubs(raw)
+	// Include original env vars, even if they're being cleared
+	if !interpnoosenv {
+		for _, v := range os.Environ() {
+			e := parsevar(v)
+			vals[e.name] = e.val
+		}
+	}
+	for _, v := range env {
+		if interpnoosenv && v.from == string(osenv) {
+			continue
+		}
+		vals[v.name] = v.val
+	}
+	// Definitions later in this source, so references to them can be resolved
+	// first (unless `singlepassinterp` is set)
+	ahead := map[string]int{}
+	for i := len(raw) - 1; i >= 0; i-- {
+		ahead[raw[i].name] = i
+	}
+	results := map[int]string{}
+	expanding := map[int]bool{}
+	chain := []string{}
+	var experr error
+	var expand func(i int) string
+	lookup := func(name string) (string, bool) {
+		if strings.HasPrefix(name, "source:") {
+			parts := strings.SplitN(name, ":", 3)
+			named, known := namedsources[parts[1]]
+			if (len(parts) < 3 || !known) && experr == nil {
+				experr = fmt.Errorf("No source is named %q (see --name)", parts[1])
+			}
+			if len(parts) < 3 {
+				return "", false
+			}
+			val, ok := named[parts[2]]
+			return val, ok
+		}
+		if n, err := strconv.Atoi(name); argsubs && err == nil {
+			if n >= 0 && n < len(args) {
+				return args[n], true
+			}
+			return "", false
+		}
+		if compat != nocompat && !interpnoosenv {
+			if val, ok := os.LookupEnv(name); ok {
+				return val, true
+			}
+		}
+		if val, ok := vals[name]; ok {
+			return val, true
+		}
+		i, ok := ahead[name]
+		if !ok || singlepassinterp {
+			return "", false
+		}
+		if expanding[i] {
+			// a self-reference (`${PATH}:...`) is just unset
+			if chain[len(chain)-1] != name && experr == nil {
+				for start, n := range chain {
+					if n == name {
+						cycle := append(chain[start:], name)
+						experr = fmt.Errorf("Reference cycle: %s", strings.Join(cycle, " -> "))
+						break
+					}
+				}
+			}
+			return "", false
+		}
+		return expand(i), true
+	}
+	expand = func(i int) string {
+		if val, done := results[i]; done {
+			return val
+		}
+		r := raw[i]
+		expanding[i] = true
+		chain = append(chain, r.name)
+		defer func() {
+			expanding[i] = false
+			chain = chain[:len(chain)-1]
+		}()
+		subbed := r.val
+		if r.allowsubs {
+			var replaced string
+			switch compat {
+			case dotenvexpand:
+				replaced = expandcompat(subbed, lookup)
+			case pythondotenv:
+				replaced = expandpython(subbed, lookup)
+			default:
+				var suberr error
+				replaced = interpescapes.Replace(subbed)
+				replaced = varmatch.ReplaceAllStringFunc(replaced, func(s string) string {
+					name := refname(varmatch, s)
+					var funcs []string
+					if advancedinterp {
+						funcs = strings.Split(name, "|")
+						name, funcs = funcs[0], funcs[1:]
+					}
+					val := ""
+					name, op, arg := splitexpansion(name)
+					if name != "" {
+						val, _ = lookup(name)
+					}
+					if val == "" && op == ":?" {
+						if arg == "" {
+							arg = "parameter null or not set"
+						}
+						suberr = fmt.Errorf("%s: %s", name, arg)
+					} else if val == "" && op != "" {
+						val = arg
+						if op == ":=" {
+							vals[name] = arg
+						}
+					}
+					for _, f := range funcs {
+						transformed, err := interpfunc(f, val)
+						if err != nil && varmatch == tointerp {
+							suberr = fmt.Errorf("%s: %v", r.name, err)
+						} else if err != nil {
+							warn.Printf("%s: %v", r.name, err)
+						}
+						val = transformed
+					}
+					return val
+				})
+				if commandsub && !deferinterp && suberr == nil {
+					replaced = commandsubst.ReplaceAllStringFunc(replaced, func(s string) string {
+						out, err := runsubst(s[2 : len(s)-1])
+						if err != nil && suberr == nil {
+							suberr = fmt.Errorf("%s: %v", r.name, err)
+						}
+						return out
+					})
+				}
+				if suberr != nil && experr == nil {
+					experr = suberr
+				}
+				replaced = strings.Replace(replaced, "\x00", "$", -1)
+			}
+			if !deferinterp {
+				subbed = replaced
+			}
+		}
+		results[i] = subbed
+		return subbed
+	}
+	for i, r := range raw {
+		subbed := expand(i)
+		if experr != nil {
+			return nil, experr
+		}
+		vals[r.name] = subbed
+		r.val = subbed
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// `$$` and `\$` are a literal `$`.  They're replaced with a NUL (which can't
+// be in a value) while references are substituted.
+var interpescapes = strings.NewReplacer(`$$`, "\x00", `\$`, "\x00")
+
+// A `$(command)` in a value, for `--command-sub` (commands can't contain
+// parentheses)
+var commandsubst = regexp.MustCompile(`\$\([^()]*\)`)
+
+// Run a `$(command)` with the shell, returning its output without trailing
+// newlines
+func runsubst(command string) (string, error) {
+	proc := exec.Command("sh", "-c", command)
+	proc.Stderr = os.Stderr
+	out, err := proc.Output()
+	if err != nil {
+		return "", fmt.Errorf("Command %q failed: %v", command, err)
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// Split a braced reference into the name and any `:-` (default), `:=`
+// (default and assign), or `:?` (error) operator and its argument
+func splitexpansion(ref string) (name, op, arg string) {
+	i := -1
+	for _, op := range []string{":-", ":=", ":?"} {
+		if j := strings.Index(ref, op); j >= 0 && (i < 0 || j < i) {
+			i = j
+		}
+	}
+	if i < 0 {
+		return ref, "", ""
+	}
+	return ref[:i], ref[i : i+2], ref[i+2:]
+}
+
+// Apply a `${VAR|func}` transform (unknown ones leave the value unchanged)
+func interpfunc(f, val string) (string, error) {
+	switch strings.TrimSpace(f) {
+	case "upper":
+		return strings.ToUpper(val), nil
+	case "lower":
+		return strings.ToLower(val), nil
+	case "base64":
+		return base64.StdEncoding.EncodeToString([]byte(val)), nil
+	}
+	return val, fmt.Errorf("Unknown interpolation function: %s", f)
+}
+
+// Interpolation rules emulating another tool, chosen with `--compat`
+type compatmode string
+
+const (
+	nocompat     compatmode = ""
+	dotenvexpand            = "dotenv-expand"
+	pythondotenv            = "python-dotenv"
+)
+
+var (
+	compat      = nocompat
+	expandmatch = regexp.MustCompile(`(\\)?\$(?:\{([A-Za-z_][A-Za-z0-9_]*)` +
+		`(?::?-((?:[^{}]|\{[^{}]*\})*))?\}|([A-Za-z_][A-Za-z0-9_]*))`)
+	pythonmatch = regexp.MustCompile(`\$\{([^}:]*)(?::-([^}]*))?\}`)
+)
+
+// Expand a value the way Node's `dotenv-expand` does:
+//   - `$NAME` and `${NAME}` are replaced by the value (process env first)
+//   - `${NAME:-default}` and `${NAME-default}` use `default` (itself
+//     expanded) when NAME is unset or empty
+//   - `\$` yields a literal `$`, and unknown names expand to nothing
+func expandcompat(s string, lookup func(string) (string, bool)) string {
+	return expandmatch.ReplaceAllStringFunc(s, func(m string) string {
+		idx := expandmatch.FindStringSubmatchIndex(m)
+		if idx[2] >= 0 {
+			return m[1:]
+		}
+		var name string
+		if idx[4] >= 0 {
+			name = m[idx[4]:idx[5]]
+		} else {
+			name = m[idx[8]:idx[9]]
+		}
+		if val, ok := lookup(name); ok && val != "" {
+			return val
+		}
+		if idx[6] >= 0 {
+			return expandcompat(m[idx[6]:idx[7]], lookup)
+		}
+		return ""
+	})
+}
+
+// Warn about deferred references that nothing will define
+func checkdeferred(vars []envvar, varmatch *regexp.Regexp) {
+	defined := map[string]bool{}
+	for _, v := range vars {
+		defined[v.name] = true
+	}
+	for _, v := range vars {
+		if !v.allowsubs {
+			continue
+		}
+		for _, ref := range references(v.val, varmatch) {
+			if _, err := strconv.Atoi(ref); argsubs && err == nil {
+				continue
+			}
+			if _, set := os.LookupEnv(ref); !defined[ref] && !set {
+				warn.Printf("%s references undefined variable %s", v.name, ref)
+			}
+		}
+	}
+}
+
+// Names (sorted) referenced by the `raw` values that aren't defined by `vars`
+// (or the ambient environment, unless `interpnoosenv` is set)
+func undefinedreferences(raw, vars []envvar, varmatch *regexp.Regexp) []string {
+	defined := map[string]bool{}
+	for _, v := range vars {
+		if !interpnoosenv || v.from != string(osenv) {
+			defined[v.name] = true
+		}
+	}
+	undefined := map[string]bool{}
+	names := []string{}
+	for _, v := range raw {
+		if !v.allowsubs || v.tombstone {
+			continue
+		}
+		for _, ref := range references(v.val, varmatch) {
+			if _, err := strconv.Atoi(ref); argsubs && err == nil {
+				continue
+			}
+			if strings.HasPrefix(ref, "source:") || defined[ref] || undefined[ref] {
+				continue
+			}
+			if _, set := os.LookupEnv(ref); set && !interpnoosenv {
+				continue
+			}
+			undefined[ref] = true
+			names = append(names, ref)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Expand a value the way python-dotenv does:
+//   - only `${NAME}` and `${NAME:-default}` are recognized (not `$NAME`)
+//   - the process env wins over loaded values
+//   - `default` is literal, and only used when NAME is unset (not empty)
+func expandpython(s string, lookup func(string) (string, bool)) string {
+	return pythonmatch.ReplaceAllStringFunc(s, func(m string) string {
+		parts := pythonmatch.FindStringSubmatch(m)
+		if val, ok := lookup(parts[1]); ok {
+			return val
+		}
+		return parts[2]
+	})
+}
+
+type priority struct {
+	source varsource
+	pos    int
+}
+
+type prioritysort struct {
+	sources []priority
+}
+
+func (p *prioritysort) Len() int {
+	return len(p.sources)
+}
+func (p *prioritysort) Swap(i, j int) {
+	p.sources[i], p.sources[j] = p.sources[j], p.sources[i]
+}
+func (p *prioritysort) Less(i, j int) bool {
+	a, b := p.sources[i], p.sources[j]
+	ka, kb := a.source.kind, b.source.kind
+	ra, rb := ka.rank(), kb.rank()
+	pa, pb := a.pos, b.pos
+	switch {
+	case ra != rb:
+		return ra < rb
+	}
+	return pa < pb
+}
+
+func (p *prioritysort) sort() []varsource {
+	sort.Sort(p)
+	// `-f` files take each other's places in reverse, so the last one wins
+	flagged := []int{}
+	for i, s := range p.sources {
+		if s.source.flagged {
+			flagged = append(flagged, i)
+		}
+	}
+	for i, j := 0, len(flagged)-1; i < j; i, j = i+1, j-1 {
+		a, b := flagged[i], flagged[j]
+		p.sources[a], p.sources[b] = p.sources[b], p.sources[a]
+	}
+	ret := []varsource{}
+	for _, i := range p.sources {
+		ret = append(ret, i.source)
+	}
+	return ret
+}
+
+func bypriority(sources []varsource) *prioritysort {
+	p := &prioritysort{}
 	for i, s := range sources {
 		p.sources = append(p.sources, priority{s, i})
 	}
-	return p
+	return p
+}
+
+// Within a single source, the last definition of a name wins: drop the earlier
+// ones (values or tombstones), so it's the only one interpolation sees, too
+func lastdefinitions(vars []envvar) []envvar {
+	last := map[string]int{}
+	for i, v := range vars {
+		last[v.name] = i
+	}
+	kept := []envvar{}
+	for i, v := range vars {
+		if last[v.name] == i {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// Keep the first definition of each name (in priority order), whether it's a
+// value or a `!NAME` tombstone, so a tombstone only wins where a value from
+// the same source would have
+func uniqVarsByName(allvars []envvar) ([]string, []envvar) {
+	vars := []envvar{}
+	varnames := []string{}
+	seen := map[string]bool{}
+
+	for _, v := range allvars {
+		if !seen[v.name] {
+			varnames = append(varnames, v.name)
+			seen[v.name] = true
+			vars = append(vars, v)
+		}
+	}
+
+	return varnames, vars
+}
+
+// Variables as a JSON object, keeping their order (which marshaling a map
+// wouldn't).  With `jsontyped`, numbers and booleans from typed sources are
+// output as such, rather than as strings.
+type jsonvars []envvar
+
+func (vars jsonvars) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, v := range vars {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(v.name)
+		if err != nil {
+			return nil, err
+		}
+		val := []byte(v.val)
+		if !jsontyped || !v.typed || !json.Valid(val) {
+			if val, err = json.Marshal(v.val); err != nil {
+				return nil, err
+			}
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Guess what kind of value a string holds (for annotating dumps)
+func valuetype(s string) string {
+	if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return "int"
+	}
+	if decimalfloat.MatchString(s) {
+		return "float"
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off":
+		return "bool"
+	}
+	if u, err := url.Parse(s); err == nil && u.Scheme != "" && u.Host != "" {
+		return "url"
+	}
+	return ""
+}
+
+// (`strconv.ParseFloat` also accepts "inf", "NaN", and hex floats)
+var decimalfloat = regexp.MustCompile(`^[-+]?(?:[0-9]+\.?[0-9]*|\.[0-9]+)(?:[eE][-+]?[0-9]+)?$`)
+
+var setline = regexp.MustCompile(`^(\s*(?:export\s+)?)([^\s=#]+)\s*=`)
+
+// Quote a value so the lax parser reads it back unchanged
+func laxquote(val string) string {
+	val = strings.Replace(val, `\`, `\\`, -1)
+	val = strings.Replace(val, `'`, `\'`, -1)
+	return "'" + val + "'"
+}
+
+// Double-quote a value (without `$`) so the lax parser reads it back
+// unchanged, escaping line breaks
+func laxdquote(val string) string {
+	return `"` + laxdqescapes.Replace(val) + `"`
+}
+
+var laxdqescapes = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+
+// Quote a value for an env file, but only if the lax parser needs it to be
+func laxvalue(val string) string {
+	if val == strings.TrimSpace(val) && !strings.ContainsAny(val, "\n'\"#\\$") {
+		return val
+	}
+	return laxquote(val)
 }
 
-func uniqVarsByName(allvars []envvar) ([]string, []envvar) {
-	vars := []envvar{}
-	varnames := []string{}
-	varindex := map[string]int{}
+// Quote a value for a POSIX shell (no expansion at all)
+func shquote(val string) string {
+	return "'" + strings.Replace(val, "'", `'\''`, -1) + "'"
+}
 
-	for _, v := range allvars {
-		_, seen := varindex[v.name]
+// Quote a value for fish (which only has backslash escapes for `\` and `'`
+// within single quotes)
+func fishquote(val string) string {
+	val = strings.Replace(val, `\`, `\\`, -1)
+	return "'" + strings.Replace(val, "'", `\'`, -1) + "'"
+}
+
+// Quote a value for PowerShell (single quotes are doubled within them)
+func psquote(val string) string {
+	return "'" + strings.Replace(val, "'", "''", -1) + "'"
+}
+
+// Escape an argument for `xargs`, which splits its input at blanks and line
+// breaks, and treats quotes and backslashes specially
+func xargsquote(arg string) string {
+	var quoted strings.Builder
+	for _, c := range arg {
+		if strings.ContainsRune(" \t\n\r\v\f'\"\\", c) {
+			quoted.WriteByte('\\')
+		}
+		quoted.WriteRune(c)
+	}
+	return quoted.String()
+}
+
+// Quote a value for a POSIX shell, leaving references (and `$(command)`s,
+// with `commandsub`) to be expanded (for `--defer-interp`).  Any other `$`,
+// including an escaped one (`$$` or `\$`), is literal.
+func shdquote(val string, varmatch *regexp.Regexp) string {
+	val = interpescapes.Replace(val)
+	refs := map[int]bool{}
+	for _, loc := range varmatch.FindAllStringIndex(val, -1) {
+		refs[loc[0]] = true
+	}
+	commands := map[int]int{}
+	if commandsub {
+		for _, loc := range commandsubst.FindAllStringIndex(val, -1) {
+			commands[loc[0]] = loc[1]
+		}
+	}
+	var quoted strings.Builder
+	quoted.WriteString(`"`)
+	copied := 0
+	for i, c := range val {
+		if i < copied {
+			continue
+		} else if end, ok := commands[i]; ok {
+			// (a command is parsed on its own, so it's copied as-is)
+			quoted.WriteString(strings.Replace(val[i:end], "\x00", `\$`, -1))
+			copied = end
+			continue
+		}
 		switch {
-		case !seen:
-			varnames = append(varnames, v.name)
-			varindex[v.name] = len(vars)
-			vars = append(vars, v)
-		case v.tombstone:
-			vars[varindex[v.name]] = v
+		case c == '\x00' || (c == '$' && !refs[i]):
+			quoted.WriteString(`\$`)
+		case c == '\\' || c == '"' || c == '`':
+			quoted.WriteString(`\` + string(c))
+		default:
+			quoted.WriteRune(c)
 		}
 	}
+	quoted.WriteString(`"`)
+	return quoted.String()
+}
+
+// Quote a variable's value for a POSIX shell, leaving deferred references
+// for the shell to expand (values that aren't interpolated are literal)
+func deferquote(v envvar, varmatch *regexp.Regexp) string {
+	if deferinterp && v.allowsubs {
+		return shdquote(v.val, varmatch)
+	}
+	return shquote(v.val)
+}
 
-	return varnames, vars
+// Write a script that reproduces the environment when sourced by a POSIX
+// shell: removed variables are unset, and the rest are exported (via `set
+// -a`).  Deferred references are left for the shell to expand, in dependency
+// order.  Names a shell can't assign are skipped.
+func writeshellscript(w io.Writer, vars []envvar, unset []string, varmatch *regexp.Regexp) {
+	if deferinterp {
+		ordered, err := depsort(vars, varmatch)
+		if err != nil {
+			warn.Printf("Not sorting by dependency: %v", err)
+		}
+		vars = ordered
+	}
+	warn.flush()
+	fmt.Fprintln(w, "#!/bin/sh")
+	for _, n := range unset {
+		if assignment.MatchString(n + "=") {
+			fmt.Fprintf(w, "unset %s\n", n)
+		}
+	}
+	fmt.Fprintln(w, "set -a")
+	for _, v := range vars {
+		if !assignment.MatchString(v.name + "=") {
+			warn.Printf("Skipping %s: not a valid shell variable name", v.name)
+			continue
+		}
+		fmt.Fprintf(w, "%s=%s\n", v.name, deferquote(v, varmatch))
+	}
+	fmt.Fprintln(w, "set +a")
+	warn.flush()
+}
+
+// Implement `dotenv set [-f FILE] NAME=VALUE...`: replace any existing
+// assignments to NAME in FILE, and append the rest.
+func setcommand(args []string) error {
+	filename := ".env"
+	assignments := []envvar{}
+	for len(args) > 0 {
+		arg := args[0]
+		args = args[1:]
+		switch {
+		case arg == "-f":
+			if len(args) == 0 {
+				return fmt.Errorf("Flag `-f` requires a filename")
+			}
+			filename, args = args[0], args[1:]
+		case arg == "--":
+		case nonstrict.MatchString(arg):
+			assignments = append(assignments, parsevar(arg))
+		default:
+			return fmt.Errorf("Expected NAME=VALUE, got: %s", arg)
+		}
+	}
+	if len(assignments) == 0 {
+		return fmt.Errorf("Nothing to set")
+	}
+	perm := os.FileMode(0644)
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		if info, err := os.Stat(filename); err == nil {
+			perm = info.Mode().Perm()
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	lines := []string{}
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	done := map[string]bool{}
+	for _, v := range assignments {
+		for i, line := range lines {
+			if m := setline.FindStringSubmatch(line); m != nil && m[2] == v.name {
+				lines[i] = m[1] + v.name + "=" + laxquote(v.val)
+				done[v.name] = true
+			}
+		}
+		if !done[v.name] {
+			lines = append(lines, v.name+"="+laxquote(v.val))
+			done[v.name] = true
+		}
+	}
+	return ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), perm)
+}
+
+// Read a command from a file: one argument per line, or shell-style words
+func readcmdfile(filename string, shellsplit bool) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimSuffix(string(data), "\n")
+	if shellsplit {
+		return shellwords.Parse(text)
+	}
+	if text == "" {
+		return nil, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+func isfile(name string) bool {
+	info, err := os.Stat(name)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// One difference between two sets of variables
+type vardiff struct {
+	name, old, new string
+	added, removed bool
+}
+
+// Compare variables by name (ordered by name)
+func diffvars(old, new []envvar) []vardiff {
+	oldvals, newvals := map[string]string{}, map[string]string{}
+	allnames := []string{}
+	for _, v := range old {
+		if _, seen := oldvals[v.name]; !seen {
+			allnames = append(allnames, v.name)
+		}
+		oldvals[v.name] = v.val
+	}
+	for _, v := range new {
+		_, seenold := oldvals[v.name]
+		if _, seen := newvals[v.name]; !seen && !seenold {
+			allnames = append(allnames, v.name)
+		}
+		newvals[v.name] = v.val
+	}
+	sort.Strings(allnames)
+	diffs := []vardiff{}
+	for _, n := range allnames {
+		oldval, inold := oldvals[n]
+		newval, innew := newvals[n]
+		switch {
+		case !inold:
+			diffs = append(diffs, vardiff{name: n, new: newval, added: true})
+		case !innew:
+			diffs = append(diffs, vardiff{name: n, old: oldval, removed: true})
+		case oldval != newval:
+			diffs = append(diffs, vardiff{name: n, old: oldval, new: newval})
+		}
+	}
+	return diffs
+}
+
+// Warn about names set more than once by a single source (once per name,
+// listing the lines that set it, when known)
+func samesourceduplicates(vars []envvar) {
+	lines := map[string][]string{}
+	names := []string{}
+	for _, v := range vars {
+		if v.tombstone {
+			continue
+		}
+		if _, seen := lines[v.name]; !seen {
+			names = append(names, v.name)
+		}
+		lines[v.name] = append(lines[v.name], strconv.Itoa(v.line))
+	}
+	for _, n := range names {
+		if len(lines[n]) < 2 {
+			continue
+		}
+		if lines[n][0] == "0" {
+			warn.Printf("%s is set %d times (the last one wins)", n, len(lines[n]))
+		} else {
+			warn.Printf("%s is set on lines %s (the last one wins)", n, strings.Join(lines[n], ", "))
+		}
+	}
+}
+
+// Print variables that more than one source set to different values (in
+// source priority order), returning how many there were
+func printduplicates(vars []envvar) int {
+	byname := map[string][]envvar{}
+	allnames := []string{}
+	for _, v := range vars {
+		if _, seen := byname[v.name]; !seen {
+			allnames = append(allnames, v.name)
+		}
+		byname[v.name] = append(byname[v.name], v)
+	}
+	sort.Strings(allnames)
+	conflicts := 0
+	for _, n := range allnames {
+		defs, differ := byname[n], false
+		for _, v := range defs[1:] {
+			if v.val != defs[0].val || v.tombstone != defs[0].tombstone {
+				differ = true
+			}
+		}
+		if !differ {
+			continue
+		}
+		conflicts++
+		fmt.Printf("%s:\n", n)
+		for _, v := range defs {
+			if v.tombstone {
+				fmt.Printf("  %s: (unset)\n", v.from)
+			} else {
+				fmt.Printf("  %s: %s\n", v.from, laxvalue(v.val))
+			}
+		}
+	}
+	return conflicts
+}
+
+// Rename variables starting with `prefix` to the rest of their names.  When
+// that collides with an unprefixed variable, the renamed one wins, with a
+// warning.
+func stripprefix(vars []envvar, prefix string) []envvar {
+	renamed := map[string]string{}
+	for _, v := range vars {
+		if strings.HasPrefix(v.name, prefix) && len(v.name) > len(prefix) {
+			renamed[v.name[len(prefix):]] = v.name
+		}
+	}
+	stripped := []envvar{}
+	for _, v := range vars {
+		if strings.HasPrefix(v.name, prefix) && len(v.name) > len(prefix) {
+			v.name = v.name[len(prefix):]
+		} else if orig, ok := renamed[v.name]; ok {
+			warn.Printf("%s replaces %s (--strip-prefix)", orig, v.name)
+			continue
+		}
+		stripped = append(stripped, v)
+	}
+	return stripped
+}
+
+// Convert variables' names (for `--uppercase` and `--lowercase`), warning
+// about names that only differed by case (in any source read so far, tracked
+// by `origs`), since only one of their values is used, as for any repeated
+// name: the last one in a source, or the one from the source that wins
+func recase(vars []envvar, convert func(string) string, flag string,
+	origs map[string]string) []envvar {
+	for i, v := range vars {
+		converted := convert(v.name)
+		if orig, seen := origs[converted]; seen && orig != v.name {
+			warn.Printf("%s and %s are both %s (-%s)", orig, v.name, converted, flag)
+		} else if !seen {
+			origs[converted] = v.name
+		}
+		vars[i].name = converted
+	}
+	return vars
+}
+
+func hasvar(vars []envvar, name string) bool {
+	for _, v := range vars {
+		if v.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Names whose values shouldn't be echoed when prompting for them
+var secretname = regexp.MustCompile(`(?i)secret|passw|token|key|credential|private`)
+
+var promptreader *bufio.Reader
+
+// Ask for the value of a variable on the terminal (prompting on stderr)
+func prompt(name string) (string, error) {
+	fmt.Fprintf(os.Stderr, "%s: ", name)
+	if secretname.MatchString(name) {
+		val, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(val), err
+	}
+	if promptreader == nil {
+		promptreader = bufio.NewReader(os.Stdin)
+	}
+	line, err := promptreader.ReadString('\n')
+	if err != nil && !(err == io.EOF && line != "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Print the resolved settings and sources (in priority order) for
+// `--print-effective-config`
+func printconfig(mode operation, outmode outputmode, sources []varsource,
+	varmatch *regexp.Regexp, sorted, depsorted bool, cmd []string) {
+	interp := "any ('$VAR' or '${VAR}')"
+	if varmatch == tointerp {
+		interp = "strict ('${VAR}' only)"
+	}
+	if compat != nocompat {
+		interp = "compat " + string(compat)
+	}
+	order := "unsorted"
+	if depsorted {
+		order = "by dependency"
+	} else if sorted {
+		order = "sorted by name"
+	}
+	fmt.Printf("mode: %s\n", mode)
+	fmt.Printf("output: %s, %s\n", outmode, order)
+	fmt.Printf("interpolation: %s", interp)
+	for _, opt := range []struct {
+		name string
+		set  bool
+	}{
+		{"deferred", deferinterp},
+		{"advanced", advancedinterp},
+		{"args", argsubs},
+		{"no-osenv", interpnoosenv},
+		{"command-sub", commandsub},
+	} {
+		if opt.set {
+			fmt.Printf(", %s", opt.name)
+		}
+	}
+	fmt.Println()
+	fmt.Println("sources (highest priority first):")
+	for i, src := range sources {
+		fmt.Printf("  %d. %s [%s, sub: %s", i+1, src.describe(), src.kind, src.getsublevel())
+		if src.explicit {
+			fmt.Printf(", explicit")
+		}
+		if src.optional {
+			fmt.Printf(", optional")
+		}
+		if src.encoding != "" {
+			fmt.Printf(", encoding: %s", src.encoding)
+		}
+		if src.name != "" {
+			fmt.Printf(", name: %s", src.name)
+		}
+		if src.block != nil {
+			fmt.Printf(", block: %d", *src.block)
+		}
+		fmt.Println("]")
+	}
+	if mode == runcmd {
+		fmt.Printf("command: %q\n", cmd)
+	}
+}
+
+// Output format matching the first source given (other than NAME=VALUE
+// arguments), for `--same-format`.  YAML is only detected with `-y`.  Files
+// of undetermined type (including `cmd:` and `git:` sources) are treated as
+// env files.
+func sourceformat(sources []varsource) outputmode {
+	for _, src := range sources {
+		switch src.kind {
+		case raw:
+			continue
+		case jsonmap, jsonarray, jsonfile, jsonstdin:
+			return jsonoutput
+		case base64file:
+			return base64output
+		case yamlfile:
+			return yamloutput
+		}
+		return textoutput
+	}
+	return textoutput
+}
+
+// Exit status for a command that couldn't be started, following shell
+// conventions: 127 = not found, 126 = found, but not executable
+func startstatus(err error) int {
+	if perr, ok := err.(*os.PathError); ok {
+		err = perr.Err
+	}
+	if eerr, ok := err.(*exec.Error); ok {
+		err = eerr.Err
+	}
+	switch {
+	case err == exec.ErrNotFound || os.IsNotExist(err):
+		return 127
+	case os.IsPermission(err) || err == syscall.ENOEXEC:
+		return 126
+	}
+	return 1
+}
+
+// Parse a source, giving up on it after `timeout` (if non-zero)
+func parsewithtimeout(src varsource, timeout time.Duration) ([]envvar, error) {
+	if timeout <= 0 {
+		return src.parse(context.Background())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	vars, err := src.parse(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("Timed out after %v", timeout)
+	}
+	return vars, err
 }
 
 type operation string
 
 const (
-	runcmd operation = "runcmd"
-	dump             = "dump"
-	names            = "names"
-	values           = "values"
+	runcmd        operation = "runcmd"
+	dump                    = "dump"
+	names                   = "names"
+	values                  = "values"
+	patch                   = "patch"
+	duplicates              = "duplicates"
+	diff                    = "diff"
+	count                   = "count"
+	undefinedrefs           = "undefinedrefs"
 )
 
 type outputmode string
 
 const (
-	textoutput   outputmode = "text"
-	jsonoutput              = "json"
-	nuloutput               = "nul"
-	base64output            = "base64"
-	rawoutput               = "raw"
+	textoutput       outputmode = "text"
+	jsonoutput                  = "json"
+	nuloutput                   = "nul"
+	base64output                = "base64"
+	rawoutput                   = "raw"
+	argsoutput                  = "args"
+	args0output                 = "args0"
+	shellscript                 = "shell-script"
+	yamloutput                  = "yaml"
+	exportoutput                = "export"
+	fishoutput                  = "fish"
+	powershelloutput            = "powershell"
 )
 
-func main() {
+// Main runs the `dotenv` command (see `usage`), using the arguments in os.Args
+func Main() {
 	debug = os.Getenv("DEBUG") != ""
-	warn = true
+	warn.enabled = true
 	args := os.Args[1:]
 	mode, modeset := runcmd, false
 	outmode := textoutput
@@ -669,19 +2799,80 @@ func main() {
 	defaultType = laxfile
 	specifiedDefault := false
 	var defaultSublevel *sublevel
+	defaultEncoding := ""
+	baseline := ""
+	diffold, diffnew := "", ""
+	nextName := ""
+	var nextBlock *int
 	varmatch := anyinterp
 	sorted := true
+	depsorted := false
+	annotate := false
+	printSource := false
+	skipEmpty := false
+	envelope := false
+	strictValues := false
+	quietMissing, failMissing := false, false
+	failOnConflict := false
+	printConfig := false
+	sameFormat := false
+	prefixes := []string{}
+	globs := []string{}
+	stripPrefix := ""
+	namecase := ""
+	dryRun := false
+	chdir := ""
+	var sourceTimeout, cmdTimeout time.Duration
 	clearEnv := false
+	cmdfile, cmdshell := "", false
+	dropped := map[string]bool{}
+	autojson := true
+	requireSource := false
+	required := []string{}
+	interactive := false
+	stdinUsed := false
+	stdoutFile, stderrFile, appendOutput := "", "", false
 	var cmd []string
 	var sources []varsource
 	var vars []envvar
+	var unexpanded []envvar
+
+	// Subcommands are only recognized when there's no file by that name
+	subcommand := ""
+	if len(args) > 0 {
+		if _, err := os.Stat(args[0]); err != nil {
+			switch args[0] {
+			case "run", "dump", "get", "set":
+				subcommand, args = args[0], args[1:]
+			}
+		}
+	}
+	switch subcommand {
+	case "run":
+		mode, modeset = runcmd, true
+	case "dump":
+		mode, modeset = dump, true
+	case "get":
+		mode, modeset = values, true
+	case "set":
+		if err := setcommand(args); err != nil {
+			fatal(err)
+		}
+		return
+	}
 
 	doSplit, splitIndex := false, 0
-	for i, arg := range args {
-		if arg == "--" {
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" {
 			doSplit, splitIndex = true, i
 			break
 		}
+		// `-f --` is a file named `--`, not the separator
+		flag := args[i]
+		if strings.HasPrefix(flag, "--") {
+			flag = flag[1:]
+		}
+		i += valueflags[flag]
 	}
 	if doSplit {
 		args, cmd = args[0:splitIndex], args[splitIndex+1:]
@@ -708,6 +2899,40 @@ func main() {
 		*defaultSublevel = level
 	}
 
+	flagarg := func(flag, what string) string {
+		if len(args) == 0 {
+			fatalf("Flag `%s` requires %s", flag, what)
+		}
+		val := args[0]
+		args = args[1:]
+		return val
+	}
+
+	addSource := func(source varsource) {
+		if defaultSublevel != nil {
+			source.setsublevel(*defaultSublevel)
+		}
+		source.encoding = defaultEncoding
+		source.name, nextName = nextName, ""
+		if source.data == "-" {
+			if stdinUsed {
+				fatal("Only one source can read from stdin")
+			}
+			stdinUsed = true
+		}
+		if nextBlock != nil {
+			switch source.kind {
+			case notype, file, shell, laxfile:
+				source.kind, source.explicit = laxfile, true
+			default:
+				fatalf("Flag `--block` only applies to files, not %s", source.describe())
+			}
+			source.block, nextBlock = nextBlock, nil
+		}
+		debug.Printf("adding source: %#+v\n", source)
+		sources = append(sources, source)
+	}
+
 	for len(args) > 0 {
 		arg := args[0]
 		args = args[1:]
@@ -720,43 +2945,248 @@ func main() {
 		if strings.HasPrefix(arg, "--") {
 			arg = arg[1:]
 		}
+		// `--flag=value` is the same as `--flag value`
+		eq := strings.Index(arg, "=")
+		if strings.HasPrefix(orig, "--") && eq > 0 && valueflags[arg[:eq]] > 0 {
+			args = append([]string{arg[eq+1:]}, args...)
+			arg, orig = arg[:eq], orig[:eq+1]
+		}
 		if arg == "-h" || arg == "-help" {
 			os.Stdout.Write([]byte(usage))
 			os.Exit(0)
-		} else if arg == "-f" {
+		} else if arg == "-f" || arg == "-file" || arg == "-source" {
 			debug.Printf("[%s] = File flag", arg)
 			if len(args) == 0 {
-				log.Fatal("Flag `-f` requires a filename")
+				fatal("Flag `-f` requires a filename")
+			}
+			source.data = args[0]
+			args = args[1:]
+			source.explicit = true
+			source.flagged = true
+		} else if arg == "-optional" {
+			source.data = flagarg(orig, "a filename")
+			source.optional = true
+		} else if arg == "-o" || arg == "-dump" {
+			mode, modeset = dump, true
+			continue
+		} else if arg == "-n" || arg == "-names" {
+			mode, modeset = names, true
+			continue
+		} else if arg == "-p" || arg == "-vals" {
+			mode, modeset = values, true
+			continue
+		} else if arg == "-strict-values" || arg == "-no-osenv-for-values" {
+			strictValues = true
+			continue
+		} else if arg == "-quiet-missing" {
+			quietMissing = true
+			continue
+		} else if arg == "-fail-missing" {
+			failMissing = true
+			continue
+		} else if arg == "-patch" {
+			mode, modeset = patch, true
+			baseline = flagarg(orig, "a baseline file")
+			continue
+		} else if arg == "-diff" {
+			mode, modeset = diff, true
+			diffold = flagarg(orig, "two sources")
+			diffnew = flagarg(orig, "two sources")
+			continue
+		} else if arg == "-N" || arg == "-dry-run" {
+			dryRun = true
+			continue
+		} else if arg == "-print-effective-config" {
+			printConfig = true
+			continue
+		} else if arg == "-undefined-refs" || arg == "-names-only-missing" {
+			mode, modeset = undefinedrefs, true
+			continue
+		} else if arg == "-c" || arg == "-count" {
+			mode, modeset = count, true
+			continue
+		} else if arg == "-warn-duplicates" {
+			warnduplicates = true
+			continue
+		} else if arg == "-print-duplicates" {
+			mode, modeset = duplicates, true
+			continue
+		} else if arg == "-fail-on-conflict" {
+			mode, modeset, failOnConflict = duplicates, true, true
+			continue
+		} else if arg == "-s" || arg == "-shell" {
+			setDefaultType(shell)
+			continue
+		} else if arg == "-x" || arg == "-strict" {
+			setDefaultType(file)
+			continue
+		} else if arg == "-ini" {
+			setDefaultType(inifile)
+			continue
+		} else if arg == "-toml" {
+			setDefaultType(tomlfile)
+			continue
+		} else if arg == "-y" || arg == "-yaml" {
+			setDefaultType(yamlfile)
+			continue
+		} else if arg == "-inline-comments" {
+			inlinecomments = true
+			continue
+		} else if arg == "-trim" {
+			trimvalues = true
+			continue
+		} else if arg == "-expand-escapes" {
+			expandescapes = true
+			continue
+		} else if arg == "-a" || arg == "-strict-vars" {
+			alphanumeric = true
+			continue
+		} else if arg == "-no-sort" || arg == "-unsorted" {
+			sorted = false
+			continue
+		} else if arg == "-sort" || arg == "-sorted" {
+			sorted = true
+			continue
+		} else if arg == "-sort-by-dependency" || arg == "-print-shell-exports-sorted-by-dependency" {
+			depsorted = true
+			continue
+		} else if arg == "-q" || arg == "-quiet" {
+			warn.enabled = false
+			continue
+		} else if arg == "-warn-summary" {
+			warn.summary = true
+			continue
+		} else if arg == "-encoding" {
+			defaultEncoding = flagarg(orig, "an encoding name")
+			if _, err := textencoding(defaultEncoding); err != nil {
+				fatal(err)
+			}
+			continue
+		} else if arg == "-cmd-file" {
+			cmdfile = flagarg(orig, "a filename")
+			continue
+		} else if arg == "-shell-cmd-file" {
+			cmdshell = true
+			continue
+		} else if arg == "-C" || arg == "-chdir" {
+			chdir = flagarg(orig, "a directory")
+			if info, err := os.Stat(chdir); err != nil {
+				fatalf("Flag `%s`: %v", orig, err)
+			} else if !info.IsDir() {
+				fatalf("Flag `%s`: %s is not a directory", orig, chdir)
+			}
+			continue
+		} else if arg == "-drop" {
+			dropped[flagarg(orig, "a variable name")] = true
+			continue
+		} else if arg == "-stdout" {
+			stdoutFile = flagarg(orig, "a filename")
+			continue
+		} else if arg == "-stderr" {
+			stderrFile = flagarg(orig, "a filename")
+			continue
+		} else if arg == "-append-output" {
+			appendOutput = true
+			continue
+		} else if arg == "-json-file" {
+			source.data = flagarg(orig, "a filename")
+			source.kind, source.explicit = jsonfile, true
+		} else if arg == "-array-sep" {
+			arraysep = flagarg(orig, "a separator")
+			continue
+		} else if arg == "-flatten-sep" {
+			flattensep = flagarg(orig, "a separator")
+			continue
+		} else if arg == "-file-values" {
+			filevalues = true
+			continue
+		} else if arg == "-strict-json" {
+			strictjson = true
+			continue
+		} else if arg == "-index-arrays" {
+			indexarrays = true
+			continue
+		} else if arg == "-no-auto-json" {
+			autojson = false
+			continue
+		} else if arg == "-require" {
+			for _, name := range strings.Split(flagarg(orig, "a variable name"), ",") {
+				if name != "" {
+					required = append(required, name)
+				}
+			}
+			continue
+		} else if arg == "-interactive" {
+			interactive = true
+			continue
+		} else if arg == "-require-source" || arg == "-env-file-required" {
+			requireSource = true
+			continue
+		} else if arg == "-decode-base64" {
+			if base64marker == "" {
+				base64marker = "!base64:"
+			}
+			continue
+		} else if arg == "-base64-marker" {
+			if base64marker = flagarg(orig, "a marker"); base64marker == "" {
+				fatalf("Flag `%s` requires a non-empty marker", orig)
 			}
-			source.data = args[0]
-			args = args[1:]
-			source.explicit = true
-		} else if arg == "-o" || arg == "-dump" {
-			mode, modeset = dump, true
 			continue
-		} else if arg == "-n" || arg == "-names" {
-			mode, modeset = names, true
+		} else if arg == "-command-sub" {
+			commandsub = true
 			continue
-		} else if arg == "-p" || arg == "-vals" {
-			mode, modeset = values, true
+		} else if arg == "-allow-cmd" {
+			allowcmd = true
 			continue
-		} else if arg == "-s" || arg == "-shell" {
-			setDefaultType(shell)
+		} else if arg == "-cmd-nul" {
+			cmdnul = true
 			continue
-		} else if arg == "-x" || arg == "-strict" {
-			setDefaultType(file)
+		} else if arg == "-stdin" {
+			source.data, source.explicit = "-", true
+		} else if arg == "-json-stdin" || arg == "-merge-from-stdin-json" {
+			source.data = "-"
+			source.kind, source.explicit = jsonstdin, true
+		} else if arg == "-from-base64" {
+			source.data = flagarg(orig, "a filename")
+			source.kind, source.explicit = base64file, true
+		} else if arg == "-dir-as-env" {
+			source.data = flagarg(orig, "a directory")
+			source.kind, source.explicit = dirsource, true
+		} else if arg == "-source-timeout" {
+			timeout, err := time.ParseDuration(flagarg(orig, "a duration"))
+			if err != nil {
+				fatalf("Flag `%s` requires a duration (e.g. 10s): %v", orig, err)
+			}
+			sourceTimeout = timeout
 			continue
-		} else if arg == "-a" || arg == "-strict-vars" {
-			alphanumeric = true
+		} else if arg == "-timeout" {
+			timeout, err := time.ParseDuration(flagarg(orig, "a duration"))
+			if err != nil {
+				fatalf("Flag `%s` requires a duration (e.g. 30s): %v", orig, err)
+			}
+			cmdTimeout = timeout
 			continue
-		} else if arg == "-no-sort" || arg == "-unsorted" {
-			sorted = true
+		} else if arg == "-max-sources" {
+			n, err := strconv.Atoi(flagarg(orig, "a number"))
+			if err != nil || n < 0 {
+				fatalf("Flag `%s` requires a non-negative number", orig)
+			}
+			maxsources = n
 			continue
-		} else if arg == "-sort" || arg == "-sorted" {
-			sorted = false
+		} else if arg == "-auto" {
+			for _, name := range autofiles {
+				if isfile(name) {
+					addSource(varsource{kind: source.kind, data: name, optional: true})
+				}
+			}
 			continue
-		} else if arg == "-q" || arg == "-quiet" {
-			warn = false
+		} else if arg == "-cascade" || arg == "-load-cascade" {
+			env := flagarg(orig, "an environment name")
+			for _, name := range cascadefiles(env) {
+				if isfile(name) {
+					addSource(varsource{kind: source.kind, data: name, optional: true})
+				}
+			}
 			continue
 		} else if arg == "-0" || arg == "-z" || arg == "-nul" || arg == "-null" {
 			outmode = nuloutput
@@ -764,12 +3194,79 @@ func main() {
 		} else if arg == "-j" || arg == "-json" {
 			outmode = jsonoutput
 			continue
+		} else if arg == "-json-envelope" {
+			outmode, envelope = jsonoutput, true
+			continue
 		} else if arg == "-b" || arg == "-b64" || arg == "-base64" {
 			outmode = base64output
 			continue
+		} else if arg == "-base64-sep" {
+			base64sep = flagarg(orig, "a separator")
+			if base64sep == "" || strings.ContainsAny(base64sep, base64chars+"\n") {
+				fatalf("Flag `%s` requires a separator that can't appear in Base64", orig)
+			}
+			continue
 		} else if arg == "-r" || arg == "-raw" {
 			outmode = rawoutput
 			continue
+		} else if arg == "-prefix" {
+			prefixes = append(prefixes, flagarg(orig, "a prefix"))
+			continue
+		} else if arg == "-match" {
+			glob := flagarg(orig, "a pattern")
+			if _, err := path.Match(glob, ""); err != nil {
+				fatalf("Invalid pattern for `%s`: %q", orig, glob)
+			}
+			globs = append(globs, glob)
+			continue
+		} else if arg == "-strip-prefix" {
+			stripPrefix = flagarg(orig, "a prefix")
+			continue
+		} else if arg == "-uppercase" || arg == "-lowercase" {
+			if namecase != "" && namecase != arg {
+				fatal("Flags `--uppercase` and `--lowercase` are mutually exclusive")
+			}
+			namecase = arg
+			continue
+		} else if arg == "-json-typed" {
+			jsontyped = true
+			continue
+		} else if arg == "-same-format" {
+			sameFormat = true
+			continue
+		} else if arg == "-skip-empty" || arg == "-dump-keys-only-when-set" {
+			skipEmpty = true
+			continue
+		} else if arg == "-args" || arg == "-print-as-args" {
+			outmode = argsoutput
+			continue
+		} else if arg == "-e" || arg == "-export" {
+			outmode = exportoutput
+			continue
+		} else if arg == "-fish" {
+			outmode = fishoutput
+			continue
+		} else if arg == "-powershell" {
+			outmode = powershelloutput
+			continue
+		} else if arg == "-yaml-output" {
+			outmode = yamloutput
+			continue
+		} else if arg == "-dump-shell-script" {
+			outmode = shellscript
+			continue
+		} else if arg == "-args0" {
+			outmode = args0output
+			continue
+		} else if arg == "-keep-comments" {
+			keepcomments = true
+			continue
+		} else if arg == "-annotate-types" {
+			annotate = true
+			continue
+		} else if arg == "-print-source" {
+			printSource = true
+			continue
 		} else if orig == "-" || arg == "-u" || arg == "-clear" {
 			clearEnv = true
 			continue
@@ -791,32 +3288,154 @@ func main() {
 		} else if arg == "-S" || arg == "-interpolate-strict" {
 			varmatch = tointerp
 			continue
+		} else if arg == "-defer-interp" {
+			deferinterp = true
+			continue
+		} else if arg == "-compat" {
+			switch mode := compatmode(flagarg(orig, "a tool name")); mode {
+			case dotenvexpand, pythondotenv:
+				compat = mode
+			default:
+				fatalf("Unknown compatibility mode: %s", mode)
+			}
+			continue
+		} else if arg == "-advanced-interp" {
+			advancedinterp = true
+			continue
+		} else if arg == "-block" {
+			n, err := strconv.Atoi(flagarg(orig, "a block number"))
+			if err != nil || n < 0 {
+				fatalf("Flag `%s` requires a non-negative block number", orig)
+			}
+			nextBlock = &n
+			continue
+		} else if arg == "-block-sep" {
+			blocksep = flagarg(orig, "a separator")
+			continue
+		} else if arg == "-name" {
+			nextName = flagarg(orig, "a source name")
+			continue
+		} else if arg == "-interp-only" {
+			interponly[flagarg(orig, "a variable name")] = true
+			continue
+		} else if arg == "-single-pass-interp" {
+			singlepassinterp = true
+			continue
+		} else if arg == "-interp-no-osenv" {
+			interpnoosenv = true
+			continue
+		} else if arg == "-sub-scope" {
+			switch scope := flagarg(orig, "a scope"); scope {
+			case "sources":
+				interpnoosenv = true
+			case "all":
+				interpnoosenv = false
+			default:
+				fatalf("Unknown interpolation scope: %s (expected 'sources' or 'all')", scope)
+			}
+			continue
+		} else if arg == "-interp-args" {
+			argsubs = true
+			continue
+		} else if sourceprefix(arg) != "" {
+			debug.Printf("[%s] = %s: source", arg, sourceprefix(arg))
+			source.kind, source.explicit = prefixed, true
 		} else if assignment.MatchString(arg) {
 			debug.Printf("[%s] = raw assignment", arg)
 			source.kind = raw
 		} else if strings.HasPrefix(arg, "{") && strings.HasSuffix(arg, "}") {
 			source.kind, source.explicit = jsonmap, true
+		} else if strings.HasPrefix(arg, "[") && strings.HasSuffix(arg, "]") {
+			source.kind, source.explicit = jsonarray, true
 		} else if pidspec.MatchString(arg) {
 			source.kind, source.explicit = pid, true
+		} else if autojson && strings.EqualFold(filepath.Ext(arg), ".json") && isfile(arg) {
+			debug.Printf("[%s] = JSON file", arg)
+			source.kind, source.explicit = jsonfile, true
 		} else if doSplit {
 			debug.Printf("[%s] = pre-split file source", arg)
-			source.explicit = true
+			source.optional = true
 		} else {
 			debug.Printf("[%s] = attempt file", arg)
 		}
-		if defaultSublevel != nil {
-			source.setsublevel(*defaultSublevel)
+		addSource(source)
+	}
+
+	if cmdfile != "" {
+		filecmd, err := readcmdfile(cmdfile, cmdshell)
+		if err != nil {
+			fatalf("Failed to read command file: %v", err)
 		}
-		debug.Printf("adding source: %#+v\n", source)
-		sources = append(sources, source)
+		cmd = append(filecmd, cmd...)
+	}
+
+	if maxsources > 0 && len(sources) > maxsources {
+		fatalf("Too many sources (%d > %d); raise the limit with --max-sources", len(sources), maxsources)
+	}
+
+	if sameFormat && outmode == textoutput {
+		outmode = sourceformat(sources)
 	}
 
 	if !modeset && outmode != textoutput {
 		mode = dump
 	}
 
+	// Deferring only makes sense when printing for something else to evaluate
+	if mode == runcmd {
+		deferinterp = false
+	}
+	if deferinterp && advancedinterp {
+		fatal("Flags `--defer-interp` and `--advanced-interp` are mutually exclusive " +
+			"(a shell can't apply transforms)")
+	}
+
 	setDefaultType(defaultType)
 
+	// Read a single file on its own, without merging it with anything else
+	standalone := func(data string) ([]envvar, error) {
+		source := varsource{kind: defaultType, data: data, explicit: true, encoding: defaultEncoding}
+		parsed, err := source.parse(context.Background())
+		if err == nil {
+			parsed, err = source.substitutevars(nil, parsed, varmatch, cmd)
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, parsed = uniqVarsByName(parsed)
+		return parsed, nil
+	}
+
+	// Each side of a diff is read on its own, so nothing else is loaded
+	if mode == diff {
+		sides := [][]envvar{}
+		for _, data := range []string{diffold, diffnew} {
+			parsed, err := standalone(data)
+			if err != nil {
+				fatalf("Failed to read %s: %v", data, err)
+			}
+			set := []envvar{}
+			for _, v := range parsed {
+				if !v.tombstone {
+					set = append(set, v)
+				}
+			}
+			sides = append(sides, set)
+		}
+		warn.flush()
+		for _, d := range diffvars(sides[0], sides[1]) {
+			switch {
+			case d.added:
+				fmt.Printf("+ %s=%s\n", d.name, laxvalue(d.new))
+			case d.removed:
+				fmt.Printf("- %s\n", d.name)
+			default:
+				fmt.Printf("~ %s: %s -> %s\n", d.name, laxvalue(d.old), laxvalue(d.new))
+			}
+		}
+		return
+	}
+
 	debug.Printf("Prepending osenv?: %v\n", !clearEnv)
 	if !clearEnv {
 		sources = append([]varsource{{kind: osenv}}, sources...)
@@ -830,13 +3449,104 @@ func main() {
 	}
 	sources = bypriority(sources).sort()
 
+	if printConfig {
+		printconfig(mode, outmode, sources, varmatch, sorted, depsorted, cmd)
+		return
+	}
+
 	debug.Printf("Sorted: %#+v\n", sources)
 
+	// Read a source, applying `--uppercase`/`--lowercase`
+	recased := map[string]string{}
+	readsource := func(source varsource) ([]envvar, error) {
+		parsed, err := parsewithtimeout(source, sourceTimeout)
+		if namecase != "" && source.kind != osenv {
+			convert := strings.ToUpper
+			if namecase == "-lowercase" {
+				convert = strings.ToLower
+			}
+			parsed = recase(parsed, convert, namecase, recased)
+		}
+		return parsed, err
+	}
+
+	// Interpolate the last definition of each of a source's names (given the
+	// variables from the sources before it), then apply `--file-values` and
+	// `--decode-base64`
+	expandsource := func(source varsource, env, parsed []envvar) ([]envvar, error) {
+		parsed, err := source.substitutevars(env, lastdefinitions(parsed), varmatch, cmd)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to interpolate %s: %v", source.data, err)
+		}
+		if filevalues {
+			if parsed, err = source.readfilevalues(parsed); err != nil {
+				return nil, fmt.Errorf("Failed to read a value for %s: %v", source.data, err)
+			}
+		}
+		if base64marker != "" && source.kind != osenv {
+			if parsed, err = decodebase64values(parsed); err != nil {
+				return nil, fmt.Errorf("Failed to decode a value from %s: %v", source.describe(), err)
+			}
+		}
+		return parsed, nil
+	}
+
+	// Named sources are read (and interpolated on their own) before the
+	// others, so `${source:NAME:VAR}` works in any source, regardless of
+	// priority.  Their values are kept as-is, so no `$(command)` runs twice.
+	type readresult struct {
+		vars, expanded []envvar
+		err            error
+	}
+	preread := map[int]readresult{}
+	for _, source := range sources {
+		if source.name != "" {
+			namedsources[source.name] = map[string]string{}
+		}
+	}
+	for i, source := range sources {
+		if source.name == "" {
+			continue
+		}
+		warn.source = source.describe()
+		parsed, err := readsource(source)
+		if err != nil {
+			preread[i] = readresult{err: err}
+			continue
+		}
+		expanded, err := expandsource(source, nil, parsed)
+		if err != nil {
+			fatal(err)
+		}
+		preread[i] = readresult{parsed, expanded, nil}
+		_, uniq := uniqVarsByName(expanded)
+		for _, v := range uniq {
+			if !v.tombstone {
+				namedsources[source.name][v.name] = v.val
+			}
+		}
+	}
+
+	// A source that fails to load is:
+	//   - fatal if it's explicit (`-f FILE`, `NAME=VALUE`, `--json-file`, ...)
+	//   - skipped, with a warning, if it's optional (`--optional FILE`, or any
+	//     bare filename when there's a `--` to mark where the command starts)
+	//   - otherwise the start of the command, along with everything after it
+	loaded := 0
 	for i, source := range sources {
-		parsed, err := source.parse()
+		warn.source = source.describe()
+		var parsed []envvar
+		var err error
+		pre, named := preread[i]
+		if named {
+			parsed, err = pre.vars, pre.err
+		} else {
+			parsed, err = readsource(source)
+		}
 		if err != nil && source.explicit {
+			warn.flush()
 			log.Printf("Failed to read source: %#+v", source)
-			log.Fatalf("Error was: %v", err)
+			fatalf("Error was: %v", err)
 		} else if err != nil && !source.optional {
 			debug.Printf("Failed to read source: %#+v", source)
 			debug.Printf("Treating as cmd.")
@@ -849,22 +3559,90 @@ func main() {
 		} else if err != nil {
 			debug.Printf("Failed to read source: %#+v", source)
 			debug.Printf("Ignoring.")
-			fmt.Fprintf(os.Stderr, "Error parsing %s: %v\n", source.data, err)
+			warn.Printf("Error parsing %s: %v", source.data, err)
+		} else if source.kind != osenv {
+			loaded++
+		}
+		if warnduplicates && source.kind != osenv {
+			samesourceduplicates(parsed)
+		}
+		if mode == undefinedrefs {
+			raw := lastdefinitions(parsed)
+			source.marksubs(raw)
+			unexpanded = append(unexpanded, raw...)
+		}
+		if named {
+			parsed, err = pre.expanded, nil
+		} else {
+			parsed, err = expandsource(source, vars, parsed)
+		}
+		if err != nil {
+			fatal(err)
+		}
+		for i := range parsed {
+			parsed[i].from = source.describe()
 		}
-		parsed = source.substitutevars(vars, parsed, varmatch)
 		vars = append(vars, parsed...)
 	}
+	warn.source = ""
+
+	// Checked after parsing, since unreadable bare arguments become the command
+	if requireSource && loaded == 0 {
+		fatal("No sources were loaded (--require-source)")
+	}
+
+	if mode == duplicates {
+		warn.flush()
+		if printduplicates(vars) > 0 && failOnConflict {
+			os.Exit(1)
+		}
+		return
+	}
 
 	_, vars = uniqVarsByName(vars)
 
-	setvars := []envvar{}
+	setvars, unset := []envvar{}, []string{}
 	for _, v := range vars {
 		if !v.tombstone {
 			setvars = append(setvars, v)
+		} else {
+			unset = append(unset, v.name)
 		}
 	}
 	vars = setvars
 
+	if stripPrefix != "" {
+		vars = stripprefix(vars, stripPrefix)
+	}
+
+	missing := 0
+	for _, name := range required {
+		if hasvar(vars, name) {
+			continue
+		}
+		if !interactive || !term.IsTerminal(int(os.Stdin.Fd())) {
+			log.Printf("Required variable %s is not set", name)
+			missing++
+			continue
+		}
+		val, err := prompt(name)
+		if err != nil {
+			fatalf("Failed to read a value for %s: %v", name, err)
+		}
+		vars = append(vars, envvar{name: name, val: val, from: "prompt"})
+	}
+	if missing > 0 {
+		warn.flush()
+		os.Exit(1)
+	}
+
+	if deferinterp {
+		checkdeferred(vars, varmatch)
+	}
+
+	if len(cmd) == 0 && subcommand == "get" {
+		fatal("Subcommand `get` requires a variable name")
+	}
 	if len(cmd) == 0 {
 		cmd = []string{"sh"}
 	}
@@ -874,10 +3652,35 @@ func main() {
 	debug.Printf("cmd: %q\n", cmd)
 	debug.Printf("mode: %s\n", mode)
 
+	if mode == patch {
+		parsed, err := standalone(baseline)
+		if err != nil {
+			fatalf("Failed to read baseline %s: %v", baseline, err)
+		}
+		warn.flush()
+		for _, d := range diffvars(parsed, vars) {
+			if d.removed {
+				fmt.Printf("!%s\n", d.name)
+			} else {
+				fmt.Printf("%s=%s\n", d.name, laxvalue(d.new))
+			}
+		}
+		return
+	}
+
+	if mode == undefinedrefs {
+		warn.flush()
+		for _, name := range undefinedreferences(unexpanded, vars, varmatch) {
+			fmt.Println(name)
+		}
+		return
+	}
+
 	var toDump []envvar
 	dumping := true
+	notfound := 0
 	switch mode {
-	case dump, names:
+	case dump, names, count:
 		toDump = vars
 	case values:
 		for _, key := range cmd {
@@ -888,14 +3691,17 @@ func main() {
 					found = true
 				}
 			}
-			if !found {
+			if !found && !strictValues {
 				val := os.Getenv(key)
 				if val != "" {
-					toDump = append(toDump, parsevar(val))
+					toDump = append(toDump, envvar{name: key, val: val})
 					found = true
 				}
 			}
 			if !found {
+				notfound++
+			}
+			if !found && !quietMissing {
 				log.Printf("Variable not set by dotenv: %s", key)
 			}
 		}
@@ -904,6 +3710,47 @@ func main() {
 	}
 
 	if dumping {
+		if failMissing && notfound > 0 {
+			// once the values that were found are printed, in any format
+			defer os.Exit(1)
+		}
+		if len(prefixes) > 0 {
+			matching := []envvar{}
+			for _, v := range toDump {
+				for _, p := range prefixes {
+					if strings.HasPrefix(v.name, p) {
+						matching = append(matching, v)
+						break
+					}
+				}
+			}
+			toDump = matching
+		}
+		if len(globs) > 0 {
+			matching := []envvar{}
+			for _, v := range toDump {
+				for _, g := range globs {
+					if ok, _ := path.Match(g, v.name); ok {
+						matching = append(matching, v)
+						break
+					}
+				}
+			}
+			toDump = matching
+		}
+		if skipEmpty {
+			nonempty := []envvar{}
+			for _, v := range toDump {
+				if v.val != "" {
+					nonempty = append(nonempty, v)
+				}
+			}
+			toDump = nonempty
+		}
+		if mode == count {
+			fmt.Println(len(toDump))
+			return
+		}
 		if sorted {
 			dumpnames := []string{}
 			byname := map[string]envvar{}
@@ -918,15 +3765,19 @@ func main() {
 			}
 			toDump = sorteddump
 		}
+		if depsorted {
+			ordered, err := depsort(toDump, varmatch)
+			if err != nil {
+				warn.Printf("Not sorting by dependency: %v", err)
+			}
+			toDump = ordered
+		}
+		warn.flush()
 		if outmode == jsonoutput {
 			var out interface{}
 			switch mode {
 			case dump:
-				m := map[string]string{}
-				for _, v := range toDump {
-					m[v.name] = v.val
-				}
-				out = m
+				out = jsonvars(toDump)
 			case names, values:
 				m := []string{}
 				for _, v := range toDump {
@@ -938,14 +3789,54 @@ func main() {
 				}
 				out = m
 			}
+			if envelope {
+				out = struct {
+					Sorted bool        `json:"sorted"`
+					Count  int         `json:"count"`
+					Vars   interface{} `json:"vars"`
+				}{sorted, len(toDump), out}
+			}
 			b, err := json.MarshalIndent(out, "", "  ")
 			if err != nil {
-				log.Fatal(err)
+				fatal(err)
 			}
 			os.Stdout.Write(b)
 			os.Stdout.Write([]byte("\n"))
 			return
 		}
+		if outmode == yamloutput {
+			var out interface{}
+			if mode == dump {
+				m := yaml.MapSlice{}
+				for _, v := range toDump {
+					m = append(m, yaml.MapItem{Key: v.name, Value: v.val})
+				}
+				out = m
+			} else {
+				l := []string{}
+				for _, v := range toDump {
+					if mode == values {
+						l = append(l, v.val)
+					} else {
+						l = append(l, v.name)
+					}
+				}
+				out = l
+			}
+			b, err := yaml.Marshal(out)
+			if err != nil {
+				fatal(err)
+			}
+			os.Stdout.Write(b)
+			return
+		}
+		if outmode == shellscript {
+			if mode != dump {
+				unset = nil
+			}
+			writeshellscript(os.Stdout, toDump, unset, varmatch)
+			return
+		}
 		for _, v := range toDump {
 			outfields := []string{}
 
@@ -958,6 +3849,12 @@ func main() {
 				outfields = append(outfields, v.val)
 			}
 
+			quotevalue := func(quote func(string) string) {
+				if mode != names {
+					outfields[len(outfields)-1] = quote(outfields[len(outfields)-1])
+				}
+			}
+
 			var sep, term string
 			switch outmode {
 			case textoutput:
@@ -965,31 +3862,121 @@ func main() {
 			case nuloutput:
 				sep, term = "\x00", "\x00"
 			case base64output:
-				sep, term = " ", "\n"
+				sep, term = base64sep, "\n"
 				for i, f := range outfields {
 					outfields[i] = base64.StdEncoding.EncodeToString([]byte(f))
 				}
 			case rawoutput:
 				sep, term = "", ""
+			case argsoutput:
+				sep, term = "=", "\n"
+				for i, f := range outfields {
+					outfields[i] = xargsquote(f)
+				}
+			case args0output:
+				sep, term = "=", "\x00"
+			case exportoutput:
+				sep, term = "=", "\n"
+				quotevalue(func(string) string { return deferquote(v, varmatch) })
+				if mode == dump {
+					outfields[0] = "export " + outfields[0]
+				}
+			case fishoutput:
+				sep, term = " ", "\n"
+				quotevalue(fishquote)
+				if mode == dump {
+					outfields[0] = "set -gx " + outfields[0]
+				}
+			case powershelloutput:
+				sep, term = " = ", "\n"
+				quotevalue(psquote)
+				if mode == dump {
+					outfields[0] = "$env:" + outfields[0]
+				}
+			}
+			if keepcomments && outmode == textoutput && mode == dump {
+				for _, c := range v.comments {
+					fmt.Println(c)
+				}
+			}
+			notes := []string{}
+			if annotate && outmode == textoutput && mode == dump {
+				if kind := valuetype(v.val); kind != "" {
+					notes = append(notes, kind)
+				}
+			}
+			if printSource && outmode == textoutput && (mode == dump || mode == names) && v.from != "" {
+				notes = append(notes, "from "+v.from)
+			}
+			if len(notes) > 0 {
+				term = " # " + strings.Join(notes, ", ") + term
 			}
 			fmt.Printf("%s%s", strings.Join(outfields, sep), term)
 		}
 		return
 	}
 
-	proc := exec.Command(cmd[0], cmd[1:]...)
-	proc.Stdin = os.Stdin
-	proc.Stdout = os.Stdout
-	proc.Stderr = os.Stderr
+	warn.flush()
 	env := []string{}
 	for _, v := range vars {
+		if dropped[v.name] {
+			continue
+		}
 		env = append(env, fmt.Sprintf("%s=%s", v.name, v.val))
 	}
+	if dryRun {
+		quoted := []string{}
+		for _, arg := range cmd {
+			quoted = append(quoted, shquote(arg))
+		}
+		fmt.Printf("# command\n%s\n# environment\n", strings.Join(quoted, " "))
+		for _, e := range env {
+			fmt.Println(e)
+		}
+		return
+	}
+	ctx := context.Background()
+	if cmdTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cmdTimeout)
+		defer cancel()
+	}
+	proc := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	proc.Stdin = os.Stdin
+	proc.Stdout = os.Stdout
+	proc.Stderr = os.Stderr
+	outflags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendOutput {
+		outflags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	if stdoutFile != "" {
+		out, err := os.OpenFile(stdoutFile, outflags, 0666)
+		if err != nil {
+			fatalf("Failed to open --stdout file: %v", err)
+		}
+		defer out.Close()
+		proc.Stdout = out
+	}
+	if stderrFile != "" {
+		out, err := os.OpenFile(stderrFile, outflags, 0666)
+		if err != nil {
+			fatalf("Failed to open --stderr file: %v", err)
+		}
+		defer out.Close()
+		proc.Stderr = out
+	}
 	proc.Env = env
+	proc.Dir = chdir
 	if err := proc.Start(); err != nil {
-		log.Fatalf("proc.Start: %v", err)
+		log.Printf("proc.Start: %v", err)
+		os.Exit(startstatus(err))
 	}
 	if err := proc.Wait(); err != nil {
+		// Exit like GNU timeout does
+		if ctx.Err() == context.DeadlineExceeded {
+			log.Printf("Timed out after %v: %s", cmdTimeout, cmd[0])
+			os.Exit(124)
+		}
 		if exit, ok := err.(*exec.ExitError); ok {
 			if status, ok := exit.Sys().(syscall.WaitStatus); ok {
 				os.Exit(status.ExitStatus())
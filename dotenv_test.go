@@ -0,0 +1,2190 @@
+package dotenv
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// When re-run by `run`, the test binary acts as the command
+func TestMain(m *testing.M) {
+	RegisterSource("test-upper", upperSource)
+	if os.Getenv("DOTENV_TEST_MAIN") != "" {
+		Main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// Result of running the command
+type result struct {
+	stdout, stderr string
+	status         int
+}
+
+// Run the command in `dir` with `args`
+func run(t *testing.T, dir string, args ...string) result {
+	t.Helper()
+	return runinput(t, dir, "", args...)
+}
+
+// Run the command in `dir` with `args`, reading `stdin`
+func runinput(t *testing.T, dir, stdin string, args ...string) result {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "DOTENV_TEST_MAIN=1")
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	status := 0
+	if exit, ok := err.(*exec.ExitError); ok {
+		status = exit.ExitCode()
+	} else if err != nil {
+		t.Fatalf("Failed to run %q: %v", args, err)
+	}
+	return result{stdout.String(), stderr.String(), status}
+}
+
+// Run the command (expecting success), returning its output
+func output(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	res := run(t, dir, args...)
+	if res.status != 0 {
+		t.Fatalf("%q exited %d: %s", args, res.status, res.stderr)
+	}
+	return res.stdout
+}
+
+// Make a directory containing `files` (name => contents; names may include
+// subdirectories)
+func fixtures(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// Lines of output
+func lines(s string) []string {
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// Parse a source by itself
+func parsesource(src varsource) ([]envvar, error) {
+	return src.parse(context.Background())
+}
+
+// Run with `--json` output, returning the variables' values
+func dumpjson(t *testing.T, dir string, args ...string) map[string]string {
+	t.Helper()
+	vals := map[string]string{}
+	out := output(t, dir, append([]string{"-u", "-o", "--json"}, args...)...)
+	if err := json.Unmarshal([]byte(out), &vals); err != nil {
+		t.Fatalf("%q: bad JSON (%v): %s", args, err, out)
+	}
+	return vals
+}
+
+// Variables as `NAME=value` strings (`!NAME` for tombstones), for comparing
+func assignments(vars []envvar) []string {
+	out := []string{}
+	for _, v := range vars {
+		if v.tombstone {
+			out = append(out, "!"+v.name)
+		} else {
+			out = append(out, v.name+"="+v.val)
+		}
+	}
+	return out
+}
+
+// Source `script` with sh in `dir`, and print `names` from a child shell
+// (so only exported variables are seen), each followed by `|`
+func sourced(t *testing.T, dir, script string, names ...string) string {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, "env.sh"), []byte(script), 0666); err != nil {
+		t.Fatal(err)
+	}
+	refs := []string{}
+	for _, n := range names {
+		refs = append(refs, `"${`+n+`-unset}"`)
+	}
+	sh := exec.Command("sh", "-c", `. ./env.sh && exec sh -c 'printf "%s|" `+strings.Join(refs, " ")+`'`)
+	sh.Dir = dir
+	out, err := sh.CombinedOutput()
+	if err != nil {
+		t.Errorf("Failed to source:\n%s\n%s", script, out)
+	}
+	return string(out)
+}
+
+// The environment the tests started with
+var initialenv = os.Environ()
+
+func TestScannerErrors(t *testing.T) {
+	long := "A=1\n" + "B=" + strings.Repeat("x", maxlinesize) + "\nC=3\n"
+	dir := fixtures(t, map[string]string{"long.env": long})
+	for _, kind := range []sourcetype{file, shell} {
+		// reading a directory fails on the first read
+		if _, err := parsesource(varsource{kind: kind, data: dir}); err == nil {
+			t.Errorf("%s: expected an error reading a directory", kind)
+		}
+		if testing.Short() {
+			continue
+		}
+		// a line that's too long fails partway through, keeping what came before
+		vars, err := parsesource(varsource{kind: kind, data: filepath.Join(dir, "long.env")})
+		if err == nil || !strings.Contains(err.Error(), bufio.ErrTooLong.Error()) {
+			t.Errorf("%s: expected %q, got %v", kind, bufio.ErrTooLong, err)
+		}
+		if len(vars) != 1 || vars[0].name != "A" || vars[0].val != "1" {
+			t.Errorf("%s: partial parse: got %d variables", kind, len(vars))
+		}
+	}
+}
+
+func TestMaxSources(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "A=1\n", "b.env": "B=1\n", "c.env": "C=1\n"})
+	for _, test := range []struct {
+		limit  string
+		status int
+		stderr string
+	}{
+		{"3", 0, ""},
+		{"2", 1, "Too many sources (3 > 2)"},
+		{"0", 0, ""},
+		{"-1", 1, "requires a non-negative number"},
+		{"lots", 1, "requires a non-negative number"},
+	} {
+		// (the environment doesn't count toward the limit)
+		res := run(t, dir, "-o", "--max-sources", test.limit, "-f", "a.env", "-f", "b.env", "-f", "c.env")
+		if res.status != test.status || !strings.Contains(res.stderr, test.stderr) {
+			t.Errorf("--max-sources %s: exited %d, want %d (%q): %s", test.limit, res.status, test.status, test.stderr, res.stderr)
+		}
+	}
+}
+
+// Fixtures derived from python-dotenv's own tests
+func TestPythonDotenvCompat(t *testing.T) {
+	dir := fixtures(t, map[string]string{".env": strings.Join([]string{
+		"a=b",
+		"export b=c",
+		"c='d e'",
+		`d="e f"`,
+		"e=f # comment",
+		`f="g\nh"`,
+		`g='h\ni'`,
+		"h=",
+		" i = j ",
+		`j="k'l"`,
+		`k='l"m'`,
+		`q="a \"quoted\" word"`,
+		"r=x#y",
+		"l=$a",
+		"m=${a}",
+		"n='${a}'",
+		`o="${a}"`,
+		"p=${nope:-dflt}",
+	}, "\n") + "\n"})
+	got := dumpjson(t, dir, "--compat", "python-dotenv", "-f", ".env")
+	want := map[string]string{
+		"a": "b",
+		"b": "c",
+		"c": "d e",
+		"d": "e f",
+		"e": "f",
+		"f": "g\nh",
+		"g": `h\ni`,
+		"h": "",
+		"i": "j",
+		"j": "k'l",
+		"k": `l"m`,
+		"q": `a "quoted" word`,
+		"r": "x#y",
+		// only `${...}` is expanded, and not in single quotes
+		"l": "$a",
+		"m": "b",
+		"n": "${a}",
+		"o": "b",
+		"p": "dflt",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestAdvancedInterpolation(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env":       "A=MiXed\nU=${A|upper}\nL=${A|lower}\nB=${A|base64}\nC=${A|upper|base64}\nE=${UNSET|upper}\n",
+		"unknown.env": "A=MiXed\nX=${A|nope}\n",
+	})
+	got := dumpjson(t, dir, "--advanced-interp", "-f", "a.env")
+	want := map[string]string{"A": "MiXed", "U": "MIXED", "L": "mixed", "B": "TWlYZWQ=", "C": "TUlYRUQ=", "E": ""}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, test := range []struct {
+		flags  []string
+		status int
+		out    string
+	}{
+		// an unknown function is a warning, and the value is used as-is
+		{[]string{"--advanced-interp"}, 0, "A=MiXed\nX=MiXed\n"},
+		// or an error with `-S`
+		{[]string{"--advanced-interp", "-S"}, 1, ""},
+	} {
+		res := run(t, dir, append(append([]string{"-u", "-o"}, test.flags...), "-f", "unknown.env")...)
+		if res.status != test.status || res.stdout != test.out || !strings.Contains(res.stderr, "X: Unknown interpolation function: nope") {
+			t.Errorf("%q: exited %d: got %q (%s)", test.flags, res.status, res.stdout, res.stderr)
+		}
+	}
+	// without the flag, `|` doesn't form a reference
+	if got := dumpjson(t, dir, "-f", "a.env")["U"]; got != "" {
+		t.Errorf("without --advanced-interp: got %q", got)
+	}
+	// a transformed reference still refers to the variable
+	dir = fixtures(t, map[string]string{"refs.env": "A=${B|upper}\nX=${MISSING|lower|base64}\nB=b\n"})
+	for _, test := range []struct {
+		args   []string
+		status int
+		stdout string
+		stderr string
+	}{
+		{[]string{"--undefined-refs"}, 0, "MISSING\n", ""},
+		{[]string{"-o"}, 0, "A=B\nB=b\nX=\n", ""},
+		// a shell can't apply the transforms
+		{[]string{"-e", "--defer-interp"}, 1, "", "`--defer-interp` and `--advanced-interp` are mutually exclusive"},
+	} {
+		res := run(t, dir, append(append([]string{"-u", "--advanced-interp"}, test.args...), "-f", "refs.env")...)
+		if res.status != test.status || res.stdout != test.stdout || !strings.Contains(res.stderr, test.stderr) {
+			t.Errorf("%q: exited %d: got %q (%s)", test.args, res.status, res.stdout, res.stderr)
+		}
+	}
+}
+
+func TestStrictComments(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env": "# leading\n  # indented\n#\n# \t\n\t#  \nA=1 # not a comment\nB=x#y\n",
+	})
+	for _, test := range []struct {
+		flags []string
+		want  map[string]string
+	}{
+		{nil, map[string]string{"A": "1 # not a comment", "B": "x#y"}},
+		{[]string{"--inline-comments"}, map[string]string{"A": "1", "B": "x#y"}},
+	} {
+		args := append(append([]string{"-x"}, test.flags...), "-f", "a.env")
+		if got := dumpjson(t, dir, args...); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.flags, got, test.want)
+		}
+	}
+}
+
+func TestSourceRegistry(t *testing.T) {
+	for _, test := range []struct {
+		arg, prefix string
+	}{
+		{"test-upper:a,b", "test-upper"},
+		{"test-upper:", "test-upper"},
+		{"test-lower:a", ""},
+		{"A=test-upper:a", ""},
+		{":a", ""},
+	} {
+		if got := sourceprefix(test.arg); got != test.prefix {
+			t.Errorf("%q: got prefix %q, want %q", test.arg, got, test.prefix)
+		}
+	}
+	vars, err := parsesource(varsource{kind: prefixed, data: "test-upper:a,b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := assignments(vars), []string{"a=A", "b=B"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := parsesource(varsource{kind: prefixed, data: "test-upper:"}); err == nil {
+		t.Error("expected the source's error")
+	}
+	// and on the command line
+	if got := output(t, t.TempDir(), "-u", "-o", "test-upper:x"); got != "x=X\n" {
+		t.Errorf("command line: got %q", got)
+	}
+}
+
+func TestFlattenSep(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.json": `{"db":{"host":"x","opts":{"tls":"on"}},"tags":["a","b"],"hosts":[{"h":"y"}]}`,
+	})
+	for _, test := range []struct {
+		flags []string
+		want  []string
+	}{
+		{nil, []string{"db_host=x", "db_opts_tls=on", "hosts_0_h=y", "tags=a,b"}},
+		{[]string{"--flatten-sep", "."}, []string{"db.host=x", "db.opts.tls=on", "hosts.0.h=y", "tags=a,b"}},
+		{[]string{"--flatten-sep", ""}, []string{"dbhost=x", "dboptstls=on", "hosts0h=y", "tags=a,b"}},
+		{[]string{"--index-arrays"}, []string{"db_host=x", "db_opts_tls=on", "hosts_0_h=y", "tags_0=a", "tags_1=b"}},
+		{[]string{"--index-arrays", "--flatten-sep", "__"}, []string{"db__host=x", "db__opts__tls=on", "hosts__0__h=y", "tags__0=a", "tags__1=b"}},
+	} {
+		args := append(append([]string{"-u", "-o"}, test.flags...), "--json-file", "a.json")
+		if got := lines(output(t, dir, args...)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.flags, got, test.want)
+		}
+	}
+}
+
+func TestStrictValues(t *testing.T) {
+	t.Setenv("DOTENV_TEST_AMBIENT", "ambient")
+	dir := fixtures(t, map[string]string{"a.env": "A=file\n"})
+	for _, test := range []struct {
+		flags   []string
+		want    string
+		missing []string
+	}{
+		// (the fallback sets the name, not a variable parsed from the value)
+		{nil, "file\nambient\n", []string{"NONE"}},
+		{[]string{"--strict-values"}, "file\n", []string{"DOTENV_TEST_AMBIENT", "NONE"}},
+		{[]string{"--no-osenv-for-values"}, "file\n", []string{"DOTENV_TEST_AMBIENT", "NONE"}},
+	} {
+		args := append(append([]string{"-u", "-p"}, test.flags...), "-f", "a.env", "A", "DOTENV_TEST_AMBIENT", "NONE")
+		res := run(t, dir, args...)
+		if res.status != 0 || res.stdout != test.want {
+			t.Errorf("%q: exited %d: got %q, want %q", test.flags, res.status, res.stdout, test.want)
+		}
+		for _, name := range test.missing {
+			if !strings.Contains(res.stderr, "Variable not set by dotenv: "+name+"\n") {
+				t.Errorf("%q: expected %s to be reported missing: %s", test.flags, name, res.stderr)
+			}
+		}
+	}
+}
+
+func TestPrintDuplicates(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env": "A=1\nB=same\nC=x\n",
+		"b.env": "A=2\nB=same\n!C\n",
+	})
+	// (the winning definition first)
+	conflicts := "A:\n  b.env: 2\n  a.env: 1\nC:\n  b.env: (unset)\n  a.env: x\n"
+	for _, test := range []struct {
+		flags  []string
+		status int
+		want   string
+	}{
+		// (B is set twice, but to the same value)
+		{[]string{"--print-duplicates", "-f", "a.env", "-f", "b.env"}, 0, conflicts},
+		{[]string{"--fail-on-conflict", "-f", "a.env", "-f", "b.env"}, 1, conflicts},
+		{[]string{"--fail-on-conflict", "-f", "a.env"}, 0, ""},
+	} {
+		res := run(t, dir, append([]string{"-u"}, test.flags...)...)
+		if res.status != test.status || res.stdout != test.want {
+			t.Errorf("%q: exited %d: got %q, want %q", test.flags, res.status, res.stdout, test.want)
+		}
+	}
+}
+
+func TestJSONObjectsOnly(t *testing.T) {
+	defer func(strict bool) { strictjson = strict }(strictjson)
+	for _, test := range []struct {
+		json   string
+		strict bool
+		want   []string
+		err    string
+	}{
+		{`"str"`, false, nil, "Expected a JSON object or array, not a string"},
+		{`1`, false, nil, "Expected a JSON object or array, not a number"},
+		{`true`, false, nil, "Expected a JSON object or array, not a boolean"},
+		{`null`, false, nil, "Expected a JSON object or array, not null"},
+		{`{"A":"1"`, false, nil, "unexpected EOF"},
+		{`{"A":1,}`, false, nil, "invalid character '}'"},
+		{`{"A":1} {}`, false, nil, "Unexpected data after the JSON value"},
+		// an array is read like a `[...]` source
+		{`["A=1",{"name":"B","value":2},"!C"]`, false, []string{"A=1", "B=2", "!C"}, ""},
+		{`[1]`, false, nil, "JSON array element 0 is a number, not an object or string"},
+		{`["A=1"`, false, nil, "unexpected EOF"},
+		// (every value can be represented, now)
+		{`{"A":"1","N":2}`, true, []string{"A=1", "N=2"}, ""},
+		{`{"A":{"B":[true]},"C":null}`, true, []string{"A_B=true", "!C"}, ""},
+	} {
+		strictjson = test.strict
+		vars, err := parseJson([]byte(test.json))
+		if test.err == "" {
+			if got := assignments(vars); err != nil || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("%s: got %q, want %q (%v)", test.json, got, test.want, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s (strict: %v): got error %v, want %q", test.json, test.strict, err, test.err)
+		}
+	}
+	// from a file, or stdin
+	dir := fixtures(t, map[string]string{"a.json": `[{"name":"A","value":"file"}]`})
+	if got := output(t, dir, "-u", "-o", "--json-file", "a.json"); got != "A=file\n" {
+		t.Errorf("--json-file: got %q", got)
+	}
+	res := runinput(t, dir, `["A=in"]`, "-u", "-o", "--json-stdin")
+	if res.status != 0 || res.stdout != "A=in\n" {
+		t.Errorf("--json-stdin: exited %d: got %q (%s)", res.status, res.stdout, res.stderr)
+	}
+}
+
+func TestFileValues(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"conf/a.env":  "S=@secret\nE=@@literal\nP=plain\n",
+		"conf/m.env":  "M=@missing\nP=plain\n",
+		"conf/secret": "s3cr3t\n",
+		"secret":      "top\n",
+	})
+	abs := "A=@" + filepath.Join(dir, "secret") + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "conf/abs.env"), []byte(abs), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		args    []string
+		status  int
+		want    []string
+		warning string
+	}{
+		// relative to the file, with one trailing newline removed
+		{[]string{"--file-values", "-f", "conf/a.env"}, 0, []string{"E=@literal", "P=plain", "S=s3cr3t"}, ""},
+		{[]string{"--file-values", "-f", "conf/abs.env"}, 0, []string{"A=top"}, ""},
+		{[]string{"-f", "conf/a.env"}, 0, []string{"E=@@literal", "P=plain", "S=@secret"}, ""},
+		// a missing file is an error for explicit sources
+		{[]string{"--file-values", "-f", "conf/m.env"}, 1, []string{""}, "M: open "},
+		{[]string{"--file-values", "conf/m.env"}, 0, []string{"P=plain"}, "Skipping M: "},
+	} {
+		res := run(t, dir, append([]string{"-u", "-o"}, test.args...)...)
+		if got := lines(res.stdout); res.status != test.status || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: exited %d: got %q, want %q (%s)", test.args, res.status, got, test.want, res.stderr)
+		}
+		if !strings.Contains(res.stderr, test.warning) {
+			t.Errorf("%q: expected %q in: %s", test.args, test.warning, res.stderr)
+		}
+	}
+}
+
+func TestFileNamedSeparator(t *testing.T) {
+	dir := fixtures(t, map[string]string{"--": "A=dashes\n", "b.env": "B=b\n"})
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-o", "-f", "--"}, "A=dashes\n"},
+		{[]string{"-o", "--source", "--"}, "A=dashes\n"},
+		{[]string{"-o", "--file", "--"}, "A=dashes\n"},
+		{[]string{"-o", "--file=--"}, "A=dashes\n"},
+		{[]string{"-o", "--source=--"}, "A=dashes\n"},
+		{[]string{"-o", "-f", "b.env", "-f", "--"}, "A=dashes\nB=b\n"},
+		// the next `--` still starts the command
+		{[]string{"-f", "--", "--", "sh", "-c", `echo "$A"`}, "dashes\n"},
+		{[]string{"--file=--", "--", "sh", "-c", `echo "$A"`}, "dashes\n"},
+		{[]string{"-f", "b.env", "--", "sh", "-c", `echo "$A$B"`}, "b\n"},
+	} {
+		if got := output(t, dir, append([]string{"-u"}, test.args...)...); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestSortFlags(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "Z=1\nA=2\nM=3\n"})
+	for _, test := range []struct {
+		flags []string
+		want  []string
+	}{
+		{nil, []string{"A=2", "M=3", "Z=1"}},
+		{[]string{"--sort"}, []string{"A=2", "M=3", "Z=1"}},
+		{[]string{"--sorted"}, []string{"A=2", "M=3", "Z=1"}},
+		{[]string{"--no-sort"}, []string{"Z=1", "A=2", "M=3"}},
+		{[]string{"--unsorted"}, []string{"Z=1", "A=2", "M=3"}},
+	} {
+		args := append(append([]string{"-u", "-o"}, test.flags...), "-f", "a.env")
+		if got := lines(output(t, dir, args...)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.flags, got, test.want)
+		}
+	}
+}
+
+func TestSourceTimeout(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "A=file\n"})
+	for _, test := range []struct {
+		args   []string
+		status int
+		want   string
+		err    string
+	}{
+		{[]string{"--source-timeout", "100ms", `cmd:sh -c "sleep 2; echo A=1"`}, 1, "", "Timed out after 100ms"},
+		{[]string{"--source-timeout", "5s", `cmd:sh -c "echo A=1"`}, 0, "A=1\n", ""},
+		// files are read regardless
+		{[]string{"--source-timeout", "1ns", "-f", "a.env"}, 0, "A=file\n", ""},
+		{[]string{"--source-timeout", "soon", "-f", "a.env"}, 1, "", "requires a duration"},
+	} {
+		res := run(t, dir, append([]string{"-u", "-o", "--allow-cmd"}, test.args...)...)
+		if res.status != test.status || res.stdout != test.want || !strings.Contains(res.stderr, test.err) {
+			t.Errorf("%q: exited %d: got %q, want %q (%s)", test.args, res.status, res.stdout, test.want, res.stderr)
+		}
+	}
+}
+
+func TestJSONMapValues(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "GONE=file\nKEPT=file\n"})
+	got := lines(output(t, dir, "-u", "-o",
+		`{"PORT":8080,"BIG":12345678901234567890,"NEG":-2,"F":1.5,"EXP":1e3,"YES":true,"NO":false,"GONE":null}`,
+		"-f", "a.env"))
+	want := []string{"BIG=12345678901234567890", "EXP=1000", "F=1.5", "KEPT=file", "NEG=-2", "NO=false", "PORT=8080", "YES=true"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDefaultExpansions(t *testing.T) {
+	for _, test := range []struct {
+		file string
+		want map[string]string
+	}{
+		{"A=${UNSET:-def}\n", map[string]string{"A": "def"}},
+		{"E=\nA=${E:-def}\n", map[string]string{"E": "", "A": "def"}},
+		{"S=set\nA=${S:-def}\n", map[string]string{"S": "set", "A": "set"}},
+		// `:-` doesn't assign
+		{"A=${UNSET:-def}\nB=${UNSET}\n", map[string]string{"A": "def", "B": ""}},
+		// `:=` does, for later references
+		{"A=${UNSET:=def}\nB=${UNSET}\n", map[string]string{"A": "def", "B": "def"}},
+		{"E=\nA=${E:=def}\nB=${E}\n", map[string]string{"E": "", "A": "def", "B": "def"}},
+		{"S=set\nA=${S:=def}\nB=${S}\n", map[string]string{"S": "set", "A": "set", "B": "set"}},
+	} {
+		dir := fixtures(t, map[string]string{"a.env": test.file})
+		if got := dumpjson(t, dir, "--single-pass-interp", "-f", "a.env"); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.file, got, test.want)
+		}
+	}
+}
+
+func TestShellScript(t *testing.T) {
+	t.Setenv("DOTENV_TEST_GONE", "before")
+	dir := fixtures(t, map[string]string{
+		"a.env":     "!DOTENV_TEST_GONE\nA=x\nB=${A}/y\nC=say \"hi\" \\ `pwd`\n",
+		"defer.env": "!DOTENV_TEST_GONE\nB=${A}/y\nA=x\nC=say \"hi\" \\ `pwd`\n",
+		"a.json":    `{"A":"it's","B":"two\nlines","C":"$HOME ${HOME} \\"}`,
+	})
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-f", "a.env"}, "unset|x|x/y|say \"hi\" \\ `pwd`|"},
+		// deferred references are expanded by the shell, in dependency order
+		{[]string{"--defer-interp", "-f", "defer.env"}, "unset|x|x/y|say \"hi\" \\ `pwd`|"},
+		{[]string{"--json-file", "a.json"}, "before|it's|two\nlines|$HOME ${HOME} \\|"},
+	} {
+		script := output(t, dir, append([]string{"-u", "--dump-shell-script"}, test.args...)...)
+		if got := sourced(t, dir, script, "DOTENV_TEST_GONE", "A", "B", "C"); got != test.want {
+			t.Errorf("%q: got %q, want %q from:\n%s", test.args, got, test.want, script)
+		}
+	}
+}
+
+func TestRequiredExpansion(t *testing.T) {
+	for _, test := range []struct {
+		file   string
+		status int
+		stderr string
+	}{
+		{"A=${UNSET:?UNSET is required}\n", 1, "UNSET: UNSET is required"},
+		{"E=\nA=${E:?E is empty}\n", 1, "E: E is empty"},
+		{"S=set\nA=${S:?S is required}\n", 0, ""},
+	} {
+		dir := fixtures(t, map[string]string{"a.env": test.file})
+		res := run(t, dir, "-u", "-o", "-f", "a.env")
+		if res.status != test.status || !strings.Contains(res.stderr, test.stderr) {
+			t.Errorf("%q: exited %d (%s), want %d (%q)", test.file, res.status, res.stderr, test.status, test.stderr)
+		}
+		if test.status == 0 && res.stdout != "A=set\nS=set\n" {
+			t.Errorf("%q: got %q", test.file, res.stdout)
+		}
+	}
+}
+
+func TestYAMLSource(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.yaml":   "A: 1\nB: true\nC: text\nD: ~\nE: 1.50\nDB:\n  HOST: x\n  TAGS: [a, b]\n  REPLICAS:\n    - host: z\n",
+		"d.yaml":   "D: unset by a.yaml\n",
+		"arr.yaml": "- a\n- b\n",
+		"str.yaml": "just a scalar\n",
+		"bad.yaml": "A: [\n",
+	})
+	got := dumpjson(t, dir, "-y", "-f", "d.yaml", "-f", "a.yaml")
+	want := map[string]string{
+		"A": "1", "B": "true", "C": "text", "E": "1.5",
+		"DB_HOST": "x", "DB_TAGS": "a,b", "DB_REPLICAS_0_host": "z",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for _, test := range []struct {
+		file, err string
+	}{
+		{"arr.yaml", "Expected a map, not an array"},
+		{"str.yaml", "Expected a map, not a string"},
+		{"bad.yaml", "did not find expected node content"},
+	} {
+		res := run(t, dir, "-u", "-o", "--yaml", "-f", test.file)
+		if res.status != 1 || !strings.Contains(res.stderr, test.err) {
+			t.Errorf("%s: exited %d, want an error %q: %s", test.file, res.status, test.err, res.stderr)
+		}
+	}
+	// and back
+	yaml := output(t, dir, "-u", "--yaml-output", "-y", "-f", "a.yaml")
+	dir2 := fixtures(t, map[string]string{"b.yaml": yaml})
+	if got := dumpjson(t, dir2, "-y", "-f", "b.yaml"); !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip: got %q, want %q from:\n%s", got, want, yaml)
+	}
+}
+
+func TestStdinSource(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "A=file\nB=file\n"})
+	for _, test := range []struct {
+		args   []string
+		stdin  string
+		status int
+		want   string
+	}{
+		{[]string{"--stdin"}, "A=in\n", 0, "A=in\n"},
+		{[]string{"-f", "-"}, "A=in\n", 0, "A=in\n"},
+		// parsed like any other file, in its place
+		{[]string{"-s", "-f", "a.env", "-f", "-"}, "export A=\"in\"\n", 0, "A=in\nB=file\n"},
+		{[]string{"-y", "--stdin"}, "A: in\n", 0, "A=in\n"},
+		{[]string{"--stdin", "-f", "-"}, "A=in\n", 1, ""},
+		{[]string{"--json-stdin", "--stdin"}, "A=in\n", 1, ""},
+	} {
+		res := runinput(t, dir, test.stdin, append([]string{"-u", "-o"}, test.args...)...)
+		if res.status != test.status || res.stdout != test.want {
+			t.Errorf("%q: exited %d: got %q, want %q (%s)", test.args, res.status, res.stdout, test.want, res.stderr)
+		}
+		if test.status != 0 && !strings.Contains(res.stderr, "Only one source can read from stdin") {
+			t.Errorf("%q: got %s", test.args, res.stderr)
+		}
+	}
+}
+
+func TestInMemorySources(t *testing.T) {
+	for _, test := range []struct {
+		kind    sourcetype
+		content string
+	}{
+		{file, "# comment\nA=1\n!B\n"},
+		{laxfile, "# comment\nexport A='1'\n!B\n"},
+		{shell, "# comment\nexport A=\"1\"\n!B\n"},
+		{inifile, "; comment\nA = 1\n!B\n"},
+		{jsonfile, `{"A":1,"B":null}`},
+		{yamlfile, "A: 1\nB: null\n"},
+		{tomlfile, "A = \"1\"\n"},
+		{base64file, "QQ== MQ==\n"},
+	} {
+		src := varsource{kind: test.kind, data: "memory", content: []byte(test.content)}
+		vars, err := parsesource(src)
+		if err != nil {
+			t.Errorf("%s: %v", test.kind, err)
+			continue
+		}
+		got := assignments(vars)
+		want := []string{"A=1", "!B"}
+		if test.kind == tomlfile || test.kind == base64file {
+			// (no way to write a tombstone)
+			want = want[:1]
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", test.kind, got, want)
+		}
+	}
+}
+
+func TestStrictMultiline(t *testing.T) {
+	for _, test := range []struct {
+		file string
+		want map[string]string
+	}{
+		{"TWO=\"line one\nline \\\"two\\\"\"\nAFTER=x\n", map[string]string{
+			"TWO":   "\"line one\nline \\\"two\\\"\"",
+			"AFTER": "x",
+		}},
+		{"FIVE=\"-----BEGIN-----\n2\n3 \\\" still open\n4\n-----END-----\"\nAFTER=x\n", map[string]string{
+			"FIVE":  "\"-----BEGIN-----\n2\n3 \\\" still open\n4\n-----END-----\"",
+			"AFTER": "x",
+		}},
+		// closed on the same line
+		{"ONE=\"a \\\" b\"\n", map[string]string{"ONE": "\"a \\\" b\""}},
+	} {
+		dir := fixtures(t, map[string]string{"a.env": test.file})
+		if got := dumpjson(t, dir, "-x", "-f", "a.env"); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.file, got, test.want)
+		}
+	}
+	dir := fixtures(t, map[string]string{"a.env": "OK=1\nA=\"never\nclosed\n"})
+	res := run(t, dir, "-u", "-o", "-x", "-f", "a.env")
+	if res.status == 0 || !strings.Contains(res.stderr, "a.env:2: Unclosed double-quoted value for A") {
+		t.Errorf("unclosed quote: exited %d: %s", res.status, res.stderr)
+	}
+}
+
+func TestExportOutput(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.json": `{"S":"two  words ","Q":"it's \"q\"","N":"a\nb","D":"$HOME ${HOME} ` + "`pwd`" + ` \\","E":""}`,
+	})
+	exports := output(t, dir, "-u", "-e", "--json-file", "a.json")
+	want := "export D='$HOME ${HOME} `pwd` \\'\nexport E=''\nexport N='a\nb'\nexport Q='it'\\''s \"q\"'\nexport S='two  words '\n"
+	if exports != want {
+		t.Errorf("got %q, want %q", exports, want)
+	}
+	got := sourced(t, dir, exports, "D", "E", "N", "Q", "S")
+	if want := "$HOME ${HOME} `pwd` \\||a\nb|it's \"q\"|two  words |"; got != want {
+		t.Errorf("sourced: got %q, want %q", got, want)
+	}
+	// only values are quoted
+	if got := output(t, dir, "-u", "-e", "-n", "--json-file", "a.json"); got != "D\nE\nN\nQ\nS\n" {
+		t.Errorf("names: got %q", got)
+	}
+	if got := output(t, dir, "-u", "-e", "-p", "--json-file", "a.json", "Q", "S"); got != "'it'\\''s \"q\"'\n'two  words '\n" {
+		t.Errorf("values: got %q", got)
+	}
+}
+
+func TestAnnotateTypes(t *testing.T) {
+	for _, test := range []struct {
+		val, kind string
+	}{
+		{"42", "int"},
+		{"-7", "int"},
+		{"1.5", "float"},
+		{".5", "float"},
+		{"1e3", "float"},
+		{"-2.5E-3", "float"},
+		{"inf", ""},
+		{"-Inf", ""},
+		{"Infinity", ""},
+		{"NaN", ""},
+		{"0x1p-2", ""},
+		{"1_000", ""},
+		{"", ""},
+		{"Yes", "bool"},
+		{"off", "bool"},
+		{"https://example.com/x", "url"},
+		{"example.com", ""},
+	} {
+		if got := valuetype(test.val); got != test.kind {
+			t.Errorf("%q: got %q, want %q", test.val, got, test.kind)
+		}
+	}
+	dir := fixtures(t, map[string]string{"a.env": "N=3\nF=nan\nB=true\n"})
+	if got := output(t, dir, "-u", "-o", "--annotate-types", "-f", "a.env"); got != "B=true # bool\nF=nan\nN=3 # int\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestFishOutput(t *testing.T) {
+	for _, test := range []struct {
+		val, quoted string
+	}{
+		{"", `''`},
+		{"two  words", `'two  words'`},
+		{"it's", `'it\'s'`},
+		{`C:\dir`, `'C:\\dir'`},
+		{`\'`, `'\\\''`},
+		{"$HOME (x) {a,b} *", `'$HOME (x) {a,b} *'`},
+		{"a\nb", "'a\nb'"},
+	} {
+		if got := fishquote(test.val); got != test.quoted {
+			t.Errorf("%q: got %s, want %s", test.val, got, test.quoted)
+		}
+	}
+	dir := fixtures(t, map[string]string{"a.env": "A=it's\nB=b\n"})
+	if got := output(t, dir, "-u", "--fish", "-f", "a.env"); got != "set -gx A 'it\\'s'\nset -gx B 'b'\n" {
+		t.Errorf("got %q", got)
+	}
+	if got := output(t, dir, "-u", "--fish", "-p", "-f", "a.env", "A"); got != "'it\\'s'\n" {
+		t.Errorf("values: got %q", got)
+	}
+}
+
+func TestArgsOutput(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.json": `{"A":"two words","B":"it's \"q\"","C":"back\\slash","D":"line\nbreak\ttab","E":""}`,
+	})
+	want := "A=two words|B=it's \"q\"|C=back\\slash|D=line\nbreak\ttab|E=|"
+	for _, test := range []struct {
+		format string
+		xargs  []string
+	}{
+		{"--args", nil},
+		{"--args0", []string{"-0"}},
+	} {
+		args := output(t, dir, "-u", "-o", test.format, "--json-file", "a.json")
+		xargs := exec.Command("xargs", append(test.xargs, "sh", "-c", `printf "%s|" "$@"`, "sh")...)
+		xargs.Stdin = strings.NewReader(args)
+		out, err := xargs.CombinedOutput()
+		if err != nil || string(out) != want {
+			t.Errorf("%s: got %q (%v), want %q from:\n%s", test.format, out, err, want, args)
+		}
+	}
+}
+
+func TestPowerShellOutput(t *testing.T) {
+	for _, test := range []struct {
+		val, quoted string
+	}{
+		{"", `''`},
+		{"two  words", `'two  words'`},
+		{"it's", `'it''s'`},
+		{"''", `''''''`},
+		// no escapes at all within single quotes
+		{"$env:HOME `n \\", "'$env:HOME `n \\'"},
+		{"a\nb", "'a\nb'"},
+	} {
+		if got := psquote(test.val); got != test.quoted {
+			t.Errorf("%q: got %s, want %s", test.val, got, test.quoted)
+		}
+	}
+	dir := fixtures(t, map[string]string{"a.env": "A=it's\nB=b\n"})
+	if got := output(t, dir, "-u", "--powershell", "-f", "a.env"); got != "$env:A = 'it''s'\n$env:B = 'b'\n" {
+		t.Errorf("got %q", got)
+	}
+	if got := output(t, dir, "-u", "--powershell", "-n", "-f", "a.env"); got != "A\nB\n" {
+		t.Errorf("names: got %q", got)
+	}
+}
+
+func TestPrefixFilter(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "AWS_KEY=1\nAWS_ID=2\nAPP_X=3\nOTHER=4\n"})
+	for _, test := range []struct {
+		flags []string
+		want  string
+	}{
+		{[]string{"--prefix", "AWS_"}, "AWS_ID=2\nAWS_KEY=1\n"},
+		{[]string{"--prefix", "AWS_", "--prefix", "APP_"}, "APP_X=3\nAWS_ID=2\nAWS_KEY=1\n"},
+		{[]string{"--prefix", "A"}, "APP_X=3\nAWS_ID=2\nAWS_KEY=1\n"},
+		{[]string{"--prefix", "aws_"}, ""},
+		{[]string{"--prefix", "APP_", "-n"}, "APP_X\n"},
+	} {
+		args := append(append([]string{"-u", "-o"}, test.flags...), "-f", "a.env")
+		if got := output(t, dir, args...); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.flags, got, test.want)
+		}
+	}
+	// the command still gets everything
+	if got := output(t, dir, "-u", "--prefix", "APP_", "-f", "a.env", "--", "sh", "-c", `echo "$OTHER"`); got != "4\n" {
+		t.Errorf("command: got %q", got)
+	}
+}
+
+func TestMatchFilter(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "AWS_A_KEY=1\nAWS_B_ID=2\nAPP_X=3\nAPP_Y_KEY=4\nOTHER=5\n"})
+	for _, test := range []struct {
+		flags []string
+		want  string
+	}{
+		{[]string{"--match", "AWS_*_KEY"}, "AWS_A_KEY=1\n"},
+		{[]string{"--match", "*_KEY"}, "APP_Y_KEY=4\nAWS_A_KEY=1\n"},
+		{[]string{"--match", "APP_?", "--match", "OTHER"}, "APP_X=3\nOTHER=5\n"},
+		{[]string{"--match", "[AO]*"}, "APP_X=3\nAPP_Y_KEY=4\nAWS_A_KEY=1\nAWS_B_ID=2\nOTHER=5\n"},
+		// with `--prefix`, names have to match both
+		{[]string{"--match", "*_KEY", "--prefix", "APP_"}, "APP_Y_KEY=4\n"},
+		{[]string{"--match", "OTHER", "--prefix", "APP_"}, ""},
+	} {
+		args := append(append([]string{"-u", "-o"}, test.flags...), "-f", "a.env")
+		if got := output(t, dir, args...); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.flags, got, test.want)
+		}
+	}
+	res := run(t, dir, "-u", "-o", "--match", "[", "-f", "a.env")
+	if res.status != 1 || !strings.Contains(res.stderr, "Invalid pattern for `--match`") {
+		t.Errorf("bad pattern: exited %d: %s", res.status, res.stderr)
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env": "APP_DB=x\nOTHER=y\n",
+		"b.env": "APP_DB=x\nDB=y\n",
+	})
+	got := lines(output(t, dir, "-u", "-o", "--strip-prefix", "APP_", "-f", "a.env"))
+	if want := []string{"DB=x", "OTHER=y"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rename: got %q, want %q", got, want)
+	}
+	res := run(t, dir, "-u", "-o", "--strip-prefix", "APP_", "-f", "b.env")
+	if res.stdout != "DB=x\n" || !strings.Contains(res.stderr, "APP_DB replaces DB (--strip-prefix)") {
+		t.Errorf("collision: got %q (%s)", res.stdout, res.stderr)
+	}
+}
+
+func TestReadOwnPid(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("can't read other processes' environments on", runtime.GOOS)
+	}
+	// (the process's environment as it started, not as modified since)
+	var name, val string
+	for _, e := range initialenv {
+		v := parsevar(e)
+		if assignment.MatchString(v.name+"=") && v.val != "" {
+			name, val = v.name, v.val
+			break
+		}
+	}
+	if name == "" {
+		t.Skip("no variable to look for")
+	}
+	src := varsource{kind: pid, data: fmt.Sprintf("pid:%d:%s", os.Getpid(), name)}
+	vars, err := parsesource(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := assignments(vars), []string{name + "=" + val}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTOMLSource(t *testing.T) {
+	braces := `# {
+A = "{\"}"
+B = '{'
+C = """
+{\
+""""
+D = '''{'''' # {
+`
+	dir := fixtures(t, map[string]string{
+		"a.toml": "A = \"a\"\nN = 5\nF = 1.50\nB = true\nD = 1979-05-27\nT = 07:32:00\n" +
+			"[db]\nhost = \"h\"\n[db.opts]\ntls = \"on\"\n",
+		"braces.toml": braces,
+		"late.toml":   braces + "E = { x = 1 }\n",
+		"inline.toml": "[db]\nhost = \"h\"\nopts = { tls = \"on\" }\n",
+		"array.toml":  "L = [\"x\", \"y\"]\n",
+		"tables.toml": "[[srv]]\nname = \"a\"\n",
+		"bad.toml":    "A = \n",
+	})
+	got := dumpjson(t, dir, "--toml", "-f", "a.toml")
+	want := map[string]string{
+		"A": "a", "N": "5", "F": "1.5", "B": "true", "D": "1979-05-27", "T": "07:32:00",
+		"db_host": "h", "db_opts_tls": "on",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// braces in strings and comments aren't inline tables
+	got = dumpjson(t, dir, "--toml", "-f", "braces.toml")
+	want = map[string]string{"A": `{"}`, "B": "{", "C": "{\"", "D": "{'"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("braces: got %q, want %q", got, want)
+	}
+	for _, test := range []struct {
+		file, err string
+	}{
+		{"inline.toml", "Unsupported inline table on line 3"},
+		{"late.toml", "Unsupported inline table on line 8"},
+		{"array.toml", "Unsupported array value for L"},
+		{"tables.toml", "Unsupported array value for srv"},
+		{"bad.toml", "expected value"},
+	} {
+		res := run(t, dir, "-u", "-o", "--toml", "-f", test.file)
+		if res.status != 1 || !strings.Contains(res.stderr, test.err) {
+			t.Errorf("%s: exited %d, want an error %q: %s", test.file, res.status, test.err, res.stderr)
+		}
+	}
+}
+
+func TestINISource(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.ini": "# comment\nTOP=1\n  ; indented comment\n[db]\nhost = h \nQ=\"say \\\"hi\\\"\"\nS='it \\n raw'\n[ other ]\nA = 2\nbad line\n",
+	})
+	for _, test := range []struct {
+		flags []string
+		want  []string
+	}{
+		{nil, []string{"TOP=1", `db_Q=say "hi"`, `db_S=it \n raw`, "db_host=h", "other_A=2"}},
+		{[]string{"--flatten-sep", "."}, []string{"TOP=1", `db.Q=say "hi"`, `db.S=it \n raw`, "db.host=h", "other.A=2"}},
+	} {
+		res := run(t, dir, append(append([]string{"-u", "-o", "--ini"}, test.flags...), "-f", "a.ini")...)
+		if got := lines(res.stdout); res.status != 0 || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: exited %d: got %q, want %q", test.flags, res.status, got, test.want)
+		}
+		if !strings.Contains(res.stderr, "Skipping invalid line: bad line") {
+			t.Errorf("%q: expected a warning: %s", test.flags, res.stderr)
+		}
+	}
+}
+
+func TestOptionEqualsValue(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env":     "APP_A=1\nAPP_B=2\nOTHER=3\n",
+		"b.env":     "A=1\n---\nA=2\n",
+		"a.json":    `{"DB":{"HOST":"h"},"L":["x","y"]}`,
+		"c.env":     "X=1\nY=$X\n",
+		"l1.env":    "A=\xe9\n",
+		"m.env":     "A=b64:MQ==\n",
+		"new.env":   "APP_A=9\nNEW=1\n",
+		"ref.env":   "R=${source:base:OTHER}\n",
+		"b64.txt":   "QVBQX0E=:MQ==\n",
+		".env.test": "T=1\n",
+		"d/K":       "v",
+		"cmd.txt":   "echo\nfrom file\n",
+		"sub/x":     "",
+	})
+	all := "APP_A=1\nAPP_B=2\nOTHER=3\n"
+	for _, test := range []struct {
+		spaced, equals []string
+		want           string
+	}{
+		{[]string{"--source", "a.env"}, []string{"--source=a.env"}, all},
+		{[]string{"--optional", "a.env"}, []string{"--optional=a.env"}, all},
+		{[]string{"--encoding", "latin1", "-f", "l1.env"}, []string{"--encoding=latin1", "-f", "l1.env"}, "A=\u00e9\n"},
+		{[]string{"--require", "APP_A", "-f", "a.env"}, []string{"--require=APP_A", "-f", "a.env"}, all},
+		{[]string{"--name", "base", "-f", "a.env", "-f", "ref.env"}, []string{"--name=base", "-f", "a.env", "-f", "ref.env"}, all + "R=3\n"},
+		{[]string{"--compat", "python-dotenv", "-f", "c.env"}, []string{"--compat=python-dotenv", "-f", "c.env"}, "X=1\nY=$X\n"},
+		{[]string{"--interp-only", "X", "-f", "c.env"}, []string{"--interp-only=X", "-f", "c.env"}, "X=1\nY=$X\n"},
+		{[]string{"--dir-as-env", "d"}, []string{"--dir-as-env=d"}, "K=v\n"},
+		{[]string{"--from-base64", "b64.txt", "--base64-sep", ":"}, []string{"--from-base64=b64.txt", "--base64-sep=:"}, "APP_A=1\n"},
+		{[]string{"--base64-marker", "b64:", "-f", "m.env"}, []string{"--base64-marker=b64:", "-f", "m.env"}, "A=1\n"},
+		{[]string{"--source-timeout", "5s", "-f", "a.env"}, []string{"--source-timeout=5s", "-f", "a.env"}, all},
+		{[]string{"--cascade", "test"}, []string{"--cascade=test"}, "T=1\n"},
+		{[]string{"--load-cascade", "test"}, []string{"--load-cascade=test"}, "T=1\n"},
+		{[]string{"--patch", "a.env", "-f", "new.env"}, []string{"--patch=a.env", "-f", "new.env"}, "APP_A=9\n!APP_B\nNEW=1\n!OTHER\n"},
+		// (the second file of a diff is always separate)
+		{[]string{"--diff", "a.env", "new.env"}, []string{"--diff=a.env", "new.env"}, "~ APP_A: 1 -> 9\n- APP_B\n+ NEW=1\n- OTHER\n"},
+		{[]string{"--prefix", "APP_", "-f", "a.env"}, []string{"--prefix=APP_", "-f", "a.env"}, "APP_A=1\nAPP_B=2\n"},
+		{[]string{"--match", "*_B", "-f", "a.env"}, []string{"--match=*_B", "-f", "a.env"}, "APP_B=2\n"},
+		{[]string{"--strip-prefix", "APP_", "-f", "a.env"}, []string{"--strip-prefix=APP_", "-f", "a.env"}, "A=1\nB=2\nOTHER=3\n"},
+		{[]string{"--max-sources", "1", "-f", "a.env"}, []string{"--max-sources=1", "-f", "a.env"}, "APP_A=1\nAPP_B=2\nOTHER=3\n"},
+		// (only the first `=` separates the value)
+		{[]string{"--json-file", "a.json", "--array-sep", "="}, []string{"--json-file=a.json", "--array-sep=="}, "DB_HOST=h\nL=x=y\n"},
+		{[]string{"--flatten-sep", "", "--json-file", "a.json"}, []string{"--flatten-sep=", "--json-file=a.json"}, "DBHOST=h\nL=x,y\n"},
+		{[]string{"--block", "1", "--block-sep", "---", "-f", "b.env"}, []string{"--block=1", "--block-sep=---", "-f", "b.env"}, "A=2\n"},
+	} {
+		for _, args := range [][]string{test.spaced, test.equals} {
+			if got := output(t, dir, append([]string{"-u", "-o"}, args...)...); got != test.want {
+				t.Errorf("%q: got %q, want %q", args, got, test.want)
+			}
+		}
+	}
+	// and when running a command
+	for _, test := range []struct {
+		spaced, equals, cmd []string
+		want                string
+	}{
+		{[]string{"--drop", "APP_A"}, []string{"--drop=APP_A"}, []string{"sh", "-c", `echo "${APP_A-unset}"`}, "unset\n"},
+		{[]string{"--chdir", "sub"}, []string{"--chdir=sub"}, []string{"sh", "-c", `basename "$PWD"`}, "sub\n"},
+		{[]string{"--timeout", "5s"}, []string{"--timeout=5s"}, []string{"echo", "ok"}, "ok\n"},
+		{[]string{"--cmd-file", "cmd.txt"}, []string{"--cmd-file=cmd.txt"}, nil, "from file\n"},
+	} {
+		for _, args := range [][]string{test.spaced, test.equals} {
+			args = append(append([]string{"-u"}, args...), "-f", "a.env")
+			if test.cmd != nil {
+				args = append(append(args, "--"), test.cmd...)
+			}
+			if got := output(t, dir, args...); got != test.want {
+				t.Errorf("%q: got %q, want %q", args, got, test.want)
+			}
+		}
+	}
+	for _, stream := range []struct{ flag, fd string }{{"--stdout", "1"}, {"--stderr", "2"}} {
+		for _, args := range [][]string{{stream.flag, "out"}, {stream.flag + "=out"}} {
+			os.Remove(filepath.Join(dir, "out"))
+			output(t, dir, append(append([]string{"-u"}, args...), "--", "sh", "-c", "echo redirected >&"+stream.fd)...)
+			if got, _ := ioutil.ReadFile(filepath.Join(dir, "out")); string(got) != "redirected\n" {
+				t.Errorf("%q: got %q", args, got)
+			}
+		}
+	}
+}
+
+func TestRepeatedFiles(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env": "A=a\nB=a\nD=a\n",
+		"b.env": "A=b\nB=b\n",
+		"c.env": "A=c\nC=c\n",
+	})
+	want := []string{"A=c", "B=b", "C=c", "D=a"}
+	// later files override earlier ones
+	for _, args := range [][]string{
+		{"-f", "a.env", "-f", "b.env", "-f", "c.env"},
+		{"--file", "a.env", "--file=b.env", "--source", "c.env"},
+	} {
+		if got := lines(output(t, dir, append([]string{"-u", "-o"}, args...)...)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %q, want %q", args, got, want)
+		}
+	}
+}
+
+func TestDollarEscapes(t *testing.T) {
+	for _, test := range []struct {
+		val, want string
+	}{
+		{"$$5", "$5"},
+		{"$$", "$"},
+		{"$$$$", "$$"},
+		{"$$HOME", "$HOME"},
+		{"$$$HOME", "$/h"},
+		{"$${HOME}", "${HOME}"},
+		{`\$HOME`, "$HOME"},
+		{`\${HOME}`, "${HOME}"},
+		{`\$`, "$"},
+		{"$$HOME is ${HOME}, \\${HOME} is $HOME", "$HOME is /h, ${HOME} is /h"},
+	} {
+		dir := fixtures(t, map[string]string{"a.env": "HOME=/h\nV=" + test.val + "\n"})
+		for _, flags := range [][]string{nil, {"-A"}} {
+			args := append(flags, "-f", "a.env")
+			if got := dumpjson(t, dir, args...)["V"]; got != test.want {
+				t.Errorf("%q %q: got %q, want %q", flags, test.val, got, test.want)
+			}
+		}
+	}
+}
+
+func TestDeferredDollarEscapes(t *testing.T) {
+	// the shell expands deferred values the same way dotenv would have
+	for _, val := range []string{
+		"$$5", "$$", "$$$$", "$$HOME", "$$$HOME", "$${HOME}", `\$HOME`, `\${HOME}`, `\$`,
+		"$$HOME is ${HOME}, \\${HOME} is $HOME",
+		"a $ b", "$(echo no)", "`echo no`", `say "hi" \ there`,
+	} {
+		dir := fixtures(t, map[string]string{"a.env": "HOME=/h\nV=" + val + "\n"})
+		for _, flags := range [][]string{nil, {"-S"}} {
+			want := dumpjson(t, dir, append(flags, "-f", "a.env")...)["V"] + "|"
+			for _, format := range []string{"-e", "--dump-shell-script"} {
+				args := append([]string{"-u", "-o", format, "--defer-interp", "-f", "a.env"}, flags...)
+				res := run(t, dir, args...)
+				if res.status != 0 || res.stderr != "" {
+					t.Errorf("%q %q: exited %d: %s", args, val, res.status, res.stderr)
+				}
+				if got := sourced(t, dir, res.stdout, "V"); got != want {
+					t.Errorf("%q %q: got %q, want %q from:\n%s", args, val, got, want, res.stdout)
+				}
+			}
+		}
+	}
+}
+
+func TestRecursiveInterpolation(t *testing.T) {
+	for _, test := range []struct {
+		file       string
+		want, once map[string]string
+	}{
+		{"A=${B}/a\nB=${C}/b\nC=c\n",
+			map[string]string{"A": "c/b/a", "B": "c/b", "C": "c"},
+			map[string]string{"A": "/a", "B": "/b", "C": "c"}},
+		{"A=${B}\nB=${UNSET}x\n",
+			map[string]string{"A": "x", "B": "x"},
+			map[string]string{"A": "", "B": "x"}},
+		// (the variable's previous value, which is unset)
+		{"A=x${A}\n", map[string]string{"A": "x"}, map[string]string{"A": "x"}},
+	} {
+		dir := fixtures(t, map[string]string{"a.env": test.file})
+		if got := dumpjson(t, dir, "-f", "a.env"); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.file, got, test.want)
+		}
+		// the old behavior is still available
+		if got := dumpjson(t, dir, "--single-pass-interp", "-f", "a.env"); !reflect.DeepEqual(got, test.once) {
+			t.Errorf("%q: single pass: got %q, want %q", test.file, got, test.once)
+		}
+	}
+	for _, test := range []struct {
+		file, cycle string
+	}{
+		{"A=${B}\nB=${A}\n", "A -> B -> A"},
+		{"A=${B}\nB=${C}\nC=${A}\n", "A -> B -> C -> A"},
+	} {
+		dir := fixtures(t, map[string]string{"a.env": test.file})
+		res := run(t, dir, "-u", "-o", "-f", "a.env")
+		if res.status == 0 || !strings.Contains(res.stderr, "Reference cycle: "+test.cycle) {
+			t.Errorf("%q: exited %d: %s", test.file, res.status, res.stderr)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	t.Setenv("DOTENV_TEST_AMBIENT", "ambient")
+	dir := fixtures(t, map[string]string{"a.env": "A=1\nB=2\nE=\n"})
+	for _, test := range []struct {
+		flags   []string
+		missing []string
+	}{
+		{[]string{"--require", "A"}, nil},
+		{[]string{"--require", "A,B", "--require", "E"}, nil},
+		{[]string{"--require", "A,,B,"}, nil},
+		// every missing variable is reported
+		{[]string{"--require", "A,C,D"}, []string{"C", "D"}},
+		{[]string{"--require", "C", "--require", "B,D"}, []string{"C", "D"}},
+		{[]string{"-u", "--require", "DOTENV_TEST_AMBIENT"}, []string{"DOTENV_TEST_AMBIENT"}},
+		{[]string{"--require", "DOTENV_TEST_AMBIENT"}, nil},
+	} {
+		res := run(t, dir, append(append([]string{"-n"}, test.flags...), "-f", "a.env")...)
+		status := 0
+		if len(test.missing) > 0 {
+			status = 1
+		}
+		if res.status != status {
+			t.Errorf("%q: exited %d, want %d (%s)", test.flags, res.status, status, res.stderr)
+		}
+		for _, name := range test.missing {
+			if !strings.Contains(res.stderr, "Required variable "+name+" is not set") {
+				t.Errorf("%q: expected %s to be reported: %s", test.flags, name, res.stderr)
+			}
+		}
+		if strings.Count(res.stderr, "Required variable") != len(test.missing) {
+			t.Errorf("%q: got %s", test.flags, res.stderr)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "A=1\nB=it's\n"})
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-N", "-f", "a.env", "--", "sh", "-c", `touch ran; echo "$A"`},
+			"# command\n'sh' '-c' 'touch ran; echo \"$A\"'\n# environment\nA=1\nB=it's\n"},
+		{[]string{"--dry-run", "--drop", "B", "-f", "a.env", "--", "touch", "ran", "it's"},
+			"# command\n'touch' 'ran' 'it'\\''s'\n# environment\nA=1\n"},
+	} {
+		if got := output(t, dir, append([]string{"-u"}, test.args...)...); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "ran")); err == nil {
+		t.Error("the command was run")
+	}
+}
+
+func TestCommandExitStatus(t *testing.T) {
+	dir := fixtures(t, map[string]string{"not-executable": "#!/bin/sh\n", "dir/file": ""})
+	for _, test := range []struct {
+		cmd    []string
+		status int
+	}{
+		{[]string{"dotenv-test-no-such-command"}, 127},
+		{[]string{"./no-such-file"}, 127},
+		{[]string{"./not-executable"}, 126},
+		{[]string{"./dir"}, 126},
+		// otherwise, the command's own status
+		{[]string{"sh", "-c", "exit 3"}, 3},
+	} {
+		if res := run(t, dir, append([]string{"-u", "--"}, test.cmd...)...); res.status != test.status {
+			t.Errorf("%q: exited %d, want %d (%s)", test.cmd, res.status, test.status, res.stderr)
+		}
+	}
+}
+
+func TestChdir(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "A=top\n", "sub/a.env": "A=sub\n"})
+	sub, err := filepath.EvalSymlinks(filepath.Join(dir, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// sources are still read relative to the current directory
+	for _, flag := range []string{"-C", "--chdir"} {
+		got := output(t, dir, "-u", flag, "sub", "-f", "a.env", "--", "sh", "-c", `pwd -P; echo "$A"`)
+		if want := sub + "\ntop\n"; got != want {
+			t.Errorf("%s: got %q, want %q", flag, got, want)
+		}
+	}
+	for _, bad := range []string{"missing", "a.env"} {
+		if res := run(t, dir, "-u", "-C", bad, "--", "pwd"); res.status != 1 || res.stdout != "" {
+			t.Errorf("-C %s: exited %d: got %q (%s)", bad, res.status, res.stdout, res.stderr)
+		}
+	}
+}
+
+func TestKeepComments(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env": "# header\n\n# about A\n# more\nA=1\nB=2\n# trailing\n",
+		"b.env": "# about C\nC=3\n",
+		"a.sh":  "# about S\nexport S=1\n",
+	})
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		// (a blank line ends a variable's comment)
+		{[]string{"-f", "a.env"}, "# about A\n# more\nA=1\nB=2\n"},
+		{[]string{"-x", "-f", "a.env"}, "# about A\n# more\nA=1\nB=2\n"},
+		{[]string{"-f", "a.env", "-f", "b.env"}, "# about A\n# more\nA=1\nB=2\n# about C\nC=3\n"},
+		{[]string{"--prefix", "C", "-f", "a.env", "-f", "b.env"}, "# about C\nC=3\n"},
+		// only for text dumps of files that keep them
+		{[]string{"-s", "-f", "a.sh"}, "S=1\n"},
+		{[]string{"-e", "-f", "b.env"}, "export C='3'\n"},
+	} {
+		args := append([]string{"-u", "-o", "--keep-comments"}, test.args...)
+		if got := output(t, dir, args...); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+	}
+	if got := output(t, dir, "-u", "-o", "-f", "a.env"); got != "A=1\nB=2\n" {
+		t.Errorf("without --keep-comments: got %q", got)
+	}
+}
+
+func TestCount(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env":     "A=1\nB=2\nAPP_C=3\n",
+		"b.env":     "!A\nD=4\n",
+		"empty.env": "",
+	})
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-f", "a.env"}, "3\n"},
+		{[]string{"--count", "-f", "a.env", "-f", "b.env"}, "3\n"},
+		{[]string{"--prefix", "APP_", "-f", "a.env"}, "1\n"},
+		{[]string{"--match", "[AB]", "-f", "a.env"}, "2\n"},
+		{[]string{"--skip-empty", "E=", "-f", "a.env"}, "3\n"},
+		{[]string{"E=", "-f", "a.env"}, "4\n"},
+		// whatever the output format
+		{[]string{"--json", "-f", "a.env"}, "3\n"},
+		{[]string{"-f", "empty.env"}, "0\n"},
+	} {
+		if got := output(t, dir, append([]string{"-u", "-c"}, test.args...)...); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	t.Setenv("DOTENV_TEST_AMBIENT", "ambient")
+	dir := fixtures(t, map[string]string{
+		"old.env":   "A=1\nB=2\nC=3\n",
+		"new.env":   "A=1\nB=two\nD=4\n",
+		"quote.env": "A=\"x y\"\nR=${A}\n",
+		"ref.env":   "A=x\nR=${A}\n",
+		"gone.env":  "!A\n",
+	})
+	for _, test := range []struct {
+		old, new string
+		want     string
+	}{
+		{"old.env", "new.env", "~ B: 2 -> two\n- C\n+ D=4\n"},
+		{"new.env", "old.env", "~ B: two -> 2\n+ C=3\n- D\n"},
+		{"old.env", "old.env", ""},
+		// each file is interpolated on its own
+		{"quote.env", "ref.env", "~ A: x y -> x\n~ R: x y -> x\n"},
+		{"quote.env", "gone.env", "- A\n- R\n"},
+	} {
+		if got := output(t, dir, "--diff", test.old, test.new); got != test.want {
+			t.Errorf("%s %s: got %q, want %q", test.old, test.new, got, test.want)
+		}
+	}
+	for _, args := range [][]string{{"--diff", "old.env"}, {"--diff", "old.env", "missing.env"}} {
+		if res := run(t, dir, args...); res.status != 1 {
+			t.Errorf("%q: exited %d (%s)", args, res.status, res.stderr)
+		}
+	}
+}
+
+func TestOptionalFiles(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "A=1\n"})
+	missing := "Error parsing missing.env: open missing.env: no such file or directory"
+	for _, test := range []struct {
+		args    []string
+		status  int
+		want    string
+		warning bool
+	}{
+		{[]string{"--optional", "missing.env", "-f", "a.env"}, 0, "1\n", true},
+		{[]string{"--optional", "a.env"}, 0, "1\n", false},
+		// as are bare files, when a `--` marks the command
+		{[]string{"missing.env", "-f", "a.env"}, 0, "1\n", true},
+		// but never files after `-f`
+		{[]string{"-f", "missing.env", "-f", "a.env"}, 1, "", false},
+	} {
+		args := append(append([]string{"-u"}, test.args...), "--", "sh", "-c", `echo "$A"`)
+		res := run(t, dir, args...)
+		if res.status != test.status || res.stdout != test.want {
+			t.Errorf("%q: exited %d: got %q, want %q (%s)", test.args, res.status, res.stdout, test.want, res.stderr)
+		}
+		if got := strings.Contains(res.stderr, missing); got != test.warning {
+			t.Errorf("%q: warning %v, want %v: %s", test.args, got, test.warning, res.stderr)
+		}
+	}
+	// without a `--`, the first unreadable bare file starts the command
+	res := run(t, dir, "-u", "missing.env", "-f", "a.env")
+	if res.status != 127 || strings.Contains(res.stderr, missing) || !strings.Contains(res.stderr, `exec: "missing.env"`) {
+		t.Errorf("no --: exited %d: %s", res.status, res.stderr)
+	}
+}
+
+func TestJSONArraySource(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "B=file\nC=file\n"})
+	for _, test := range []struct {
+		array string
+		want  []string
+	}{
+		// later entries override earlier ones
+		{`[{"name":"A","value":"1"},{"name":"A","value":2},{"name":"B","value":null}]`, []string{"A=2", "C=file"}},
+		{`[{"name":"B","value":"x"},{"name":"A","value":"2"},{"name":"B","value":null}]`, []string{"A=2", "C=file"}},
+		{`["A=1","A=2","B=x=y"]`, []string{"A=2", "B=x=y", "C=file"}},
+		// (a string without `=` sets an empty value)
+		{`["A=2","B"]`, []string{"A=2", "B=", "C=file"}},
+		{`["A=1","A=2","!B"]`, []string{"A=2", "C=file"}},
+		// the last entry for each name wins, whichever kind it is
+		{`["B=x","!B","A=2","B=y","!B"]`, []string{"A=2", "C=file"}},
+		{`["!B",{"name":"A","value":"2"},{"name":"B","value":"y"}]`, []string{"A=2", "B=y", "C=file"}},
+	} {
+		if got := lines(output(t, dir, "-u", "-o", test.array, "-f", "a.env")); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.array, got, test.want)
+		}
+	}
+	for _, test := range []struct {
+		array, err string
+	}{
+		{`[1]`, "JSON array element 0 is a number, not an object or string"},
+		{`["A=1",[]]`, "JSON array element 1 is an array, not an object or string"},
+		{`[{"value":"1"}]`, `JSON array element 0 has no "name"`},
+	} {
+		res := run(t, dir, "-u", "-o", test.array)
+		if res.status != 1 || !strings.Contains(res.stderr, test.err) {
+			t.Errorf("%s: exited %d, want an error %q: %s", test.array, res.status, test.err, res.stderr)
+		}
+	}
+}
+
+func TestFlattenJSON(t *testing.T) {
+	defer func(sep string, index bool) { flattensep, indexarrays = sep, index }(flattensep, indexarrays)
+	for _, test := range []struct {
+		json        string
+		sep         string
+		indexarrays bool
+		want        []string
+	}{
+		{`{"db":{"host":"x","port":5432}}`, "_", false, []string{"db_host=x", "db_port=5432"}},
+		{`{"db":{"host":"x"}}`, ".", false, []string{"db.host=x"}},
+		{`{"db":{"host":"x"}}`, "__", false, []string{"db__host=x"}},
+		{`{"a":{"b":{"c":"deep"}},"top":true}`, "_", false, []string{"a_b_c=deep", "top=true"}},
+		{`{"list":["a","b"]}`, "_", false, []string{"list=a,b"}},
+		{`{"list":["a","b"]}`, ".", true, []string{"list.0=a", "list.1=b"}},
+		// any mix of scalars is joined, like strings
+		{`{"list":[1,true]}`, ".", false, []string{"list=1,true"}},
+		{`{"list":["a",1.50,false]}`, ".", false, []string{"list=a,1.5,false"}},
+		{`{"list":[1,true]}`, ".", true, []string{"list.0=1", "list.1=true"}},
+		// but not objects, arrays, or nulls
+		{`{"list":[{"h":"x"},{"h":"y"}]}`, "_", false, []string{"list_0_h=x", "list_1_h=y"}},
+		{`{"list":["a",["b","c"]]}`, "_", false, []string{"list_0=a", "list_1=b,c"}},
+		{`{"list":["a",null]}`, "_", false, []string{"list_0=a", "!list_1"}},
+	} {
+		flattensep, indexarrays = test.sep, test.indexarrays
+		vars, err := parseJson([]byte(test.json))
+		if err != nil {
+			t.Errorf("%s: %v", test.json, err)
+			continue
+		}
+		if got := assignments(vars); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s (sep %q): got %q, want %q", test.json, test.sep, got, test.want)
+		}
+	}
+}
+
+func TestRecaseNames(t *testing.T) {
+	t.Setenv("dotenv_test_ambient", "ambient")
+	dir := fixtures(t, map[string]string{
+		"a.env":  "db_host=h\nMixed_Case=m\nUP=u\n",
+		"a.json": `{"db":{"port":5}}`,
+	})
+	for _, test := range []struct {
+		flags []string
+		want  []string
+	}{
+		{[]string{"--uppercase"}, []string{"DB_HOST=h", "DB_PORT=5", "MIXED_CASE=m", "UP=u"}},
+		{[]string{"--lowercase"}, []string{"db_host=h", "db_port=5", "mixed_case=m", "up=u"}},
+		{nil, []string{"Mixed_Case=m", "UP=u", "db_host=h", "db_port=5"}},
+	} {
+		args := append(append([]string{"-u", "-o"}, test.flags...), "-f", "a.env", "--json-file", "a.json")
+		if got := lines(output(t, dir, args...)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.flags, got, test.want)
+		}
+	}
+	// the environment keeps its names
+	if got := output(t, dir, "--uppercase", "-p", "dotenv_test_ambient"); got != "ambient\n" {
+		t.Errorf("environment: got %q", got)
+	}
+	// names that collide are warned about, in one source or across them
+	dir = fixtures(t, map[string]string{
+		"a.env": "foo=1\nFOO=2\n",
+		"b.env": "Foo=3\n",
+		"c.env": "FOO=4\n",
+	})
+	for _, test := range []struct {
+		files    []string
+		want     string
+		warnings []string
+	}{
+		{[]string{"a.env"}, "FOO=2\n", []string{"foo and FOO are both FOO (--uppercase)"}},
+		// (the winning source is read first)
+		{[]string{"b.env", "c.env"}, "FOO=4\n", []string{"FOO and Foo are both FOO (--uppercase)"}},
+		{[]string{"c.env", "b.env"}, "FOO=3\n", []string{"Foo and FOO are both FOO (--uppercase)"}},
+		{[]string{"c.env", "c.env"}, "FOO=4\n", nil},
+	} {
+		args := []string{"-u", "-o", "--uppercase"}
+		for _, f := range test.files {
+			args = append(args, "-f", f)
+		}
+		res := run(t, dir, args...)
+		if res.stdout != test.want || strings.Count(res.stderr, "\n") != len(test.warnings) {
+			t.Errorf("%q: got %q, want %q (%s)", test.files, res.stdout, test.want, res.stderr)
+		}
+		for _, w := range test.warnings {
+			if !strings.Contains(res.stderr, w) {
+				t.Errorf("%q: expected %q, got: %s", test.files, w, res.stderr)
+			}
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	for _, test := range []struct {
+		args   []string
+		status int
+		stderr string
+	}{
+		{[]string{"--timeout", "100ms", "--", "sleep", "5"}, 124, "Timed out after 100ms: sleep"},
+		{[]string{"--timeout=100ms", "--", "sleep", "5"}, 124, "Timed out after 100ms: sleep"},
+		// otherwise, the command's own status
+		{[]string{"--timeout", "5s", "--", "sh", "-c", "exit 3"}, 3, ""},
+		{[]string{"--timeout", "5s", "--", "true"}, 0, ""},
+		{[]string{"--timeout", "soon", "--", "true"}, 1, "requires a duration"},
+	} {
+		start := time.Now()
+		res := run(t, t.TempDir(), append([]string{"-u"}, test.args...)...)
+		if res.status != test.status || !strings.Contains(res.stderr, test.stderr) {
+			t.Errorf("%q: exited %d, want %d (%s)", test.args, res.status, test.status, res.stderr)
+		}
+		if elapsed := time.Since(start); elapsed > 4*time.Second {
+			t.Errorf("%q: took %v", test.args, elapsed)
+		}
+	}
+}
+
+func TestSubScope(t *testing.T) {
+	t.Setenv("DOTENV_TEST_AMBIENT", "ambient")
+	dir := fixtures(t, map[string]string{
+		"a.env": "A=${DOTENV_TEST_AMBIENT}/a\n",
+		"b.env": "DOTENV_TEST_AMBIENT=file\n",
+	})
+	for _, test := range []struct {
+		flags []string
+		want  string
+	}{
+		{nil, "ambient/a"},
+		{[]string{"--sub-scope", "all"}, "ambient/a"},
+		{[]string{"--sub-scope", "sources"}, "/a"},
+		{[]string{"--sub-scope=sources"}, "/a"},
+		{[]string{"--interp-no-osenv", "--sub-scope", "all"}, "ambient/a"},
+		{[]string{"--sub-scope", "all", "--interp-no-osenv"}, "/a"},
+		// other sources are still in scope
+		{[]string{"--sub-scope", "sources", "b.env"}, "file/a"},
+		{[]string{"--sub-scope", "sources", "DOTENV_TEST_AMBIENT=raw"}, "raw/a"},
+	} {
+		args := append(append([]string{"-u", "-p"}, test.flags...), "-f", "a.env", "A")
+		if got := output(t, dir, args...); got != test.want+"\n" {
+			t.Errorf("%q: got %q, want %q", test.flags, got, test.want)
+		}
+	}
+	if res := run(t, dir, "--sub-scope", "none", "-o"); res.status != 1 || !strings.Contains(res.stderr, "Unknown interpolation scope: none") {
+		t.Errorf("bad scope: exited %d: %s", res.status, res.stderr)
+	}
+}
+
+func TestCommandSub(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env":    "A=$(echo hi)\nB=x-$(printf \"%s\" \"a b\")-y\nD=$(printf \"l1\\nl2\\n\\n\")\nE=\\$(echo no)\nS='$(echo no)'\n",
+		"fail.env": "OK=1\nC=$(exit 3)\n",
+	})
+	got := dumpjson(t, dir, "--command-sub", "-f", "a.env")
+	// (trailing newlines are removed, as by a shell)
+	want := map[string]string{"A": "hi", "B": "x-a b-y", "D": "l1\nl2", "E": "$(echo no)", "S": "$(echo no)"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// only with the flag
+	if got := dumpjson(t, dir, "-f", "a.env")["A"]; got != "$(echo hi)" {
+		t.Errorf("without --command-sub: got %q", got)
+	}
+	res := run(t, dir, "-u", "-o", "--command-sub", "-f", "fail.env")
+	if res.status != 1 || !strings.Contains(res.stderr, `C: Command "exit 3" failed: exit status 3`) {
+		t.Errorf("failure: exited %d: %s", res.status, res.stderr)
+	}
+}
+
+func TestCommandSubRuns(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env": "V=$(echo run >> runs; echo v)\n",
+		"b.env": "W=${source:a:V}\n",
+	})
+	for _, test := range []struct {
+		args []string
+		runs int
+		want string
+	}{
+		{[]string{"-o", "-f", "a.env"}, 1, "V=v\n"},
+		// a named source is only interpolated once
+		{[]string{"-o", "--name", "a", "-f", "a.env", "-f", "b.env"}, 1, "V=v\nW=v\n"},
+		// a deferred command is left for the shell to run
+		{[]string{"-e", "--defer-interp", "--name", "a", "-f", "a.env"}, 0, "export V=\"$(echo run >> runs; echo v)\"\n"},
+	} {
+		os.Remove(filepath.Join(dir, "runs"))
+		got := output(t, dir, append([]string{"-u", "--command-sub"}, test.args...)...)
+		runs, _ := ioutil.ReadFile(filepath.Join(dir, "runs"))
+		if got != test.want || strings.Count(string(runs), "run\n") != test.runs {
+			t.Errorf("%q: ran %d times, want %d: got %q, want %q", test.args, strings.Count(string(runs), "run\n"), test.runs, got, test.want)
+		}
+	}
+	script := output(t, dir, "-u", "--command-sub", "-e", "--defer-interp", "-f", "a.env")
+	if got := sourced(t, dir, script, "V"); got != "v|" {
+		t.Errorf("deferred: got %q from:\n%s", got, script)
+	}
+}
+
+func TestLineNumbers(t *testing.T) {
+	for _, test := range []struct {
+		flags    []string
+		file     string
+		status   int
+		messages []string
+	}{
+		{nil, "A=1\nbad line\nB=2\n  also bad\n", 0,
+			[]string{`a.env:2: Invalid line ("bad line")`, `a.env:4: Invalid line ("  also bad")`}},
+		// (counting the lines of multi-line values)
+		{nil, "A=\"multi\nline\"\nbad line\n", 0, []string{`a.env:3: Invalid line ("bad line")`}},
+		{nil, "A=1\n\n# comment\nNAME value\n", 0, []string{`a.env:4: Invalid line ("NAME value")`}},
+		{nil, "A=1\n!B\nC='open\n", 1, []string{"a.env:3: Unclosed single-quoted value for C"}},
+		{[]string{"--ini"}, "[s]\nA = 1\n\nbad line\n", 0, []string{"a.env:4: Skipping invalid line: bad line"}},
+		{nil, "A=1\n# B=\"\n\nB=\"open\n", 1, []string{"a.env:4: Unclosed double-quoted value for B"}},
+		{[]string{"-x"}, "A=\"two\nlines\"\nB=\"open\n", 1, []string{"a.env:3: Unclosed double-quoted value for B"}},
+	} {
+		dir := fixtures(t, map[string]string{"a.env": test.file})
+		res := run(t, dir, append(append([]string{"-u", "-o"}, test.flags...), "-f", "a.env")...)
+		if res.status != test.status {
+			t.Errorf("%q %q: exited %d, want %d (%s)", test.flags, test.file, res.status, test.status, res.stderr)
+		}
+		for _, msg := range test.messages {
+			if !strings.Contains(res.stderr, msg) {
+				t.Errorf("%q %q: expected %q in: %s", test.flags, test.file, msg, res.stderr)
+			}
+		}
+	}
+}
+
+func TestBase64LineNumbers(t *testing.T) {
+	dir := fixtures(t, map[string]string{"b64.txt": "QQ== MQ==\n\nQg==\n"})
+	for _, test := range []struct {
+		args  []string
+		stdin string
+		want  string
+	}{
+		{[]string{"--from-base64", "b64.txt"}, "", "b64.txt:3: expected two Base64 fields"},
+		{[]string{"--from-base64", "-"}, "QQ== MQ==\n!! MQ==\n", "stdin:2: illegal base64 data"},
+	} {
+		res := runinput(t, dir, test.stdin, append([]string{"-u", "-o"}, test.args...)...)
+		if res.status == 0 || !strings.Contains(res.stderr, test.want) {
+			t.Errorf("%q: exited %d, expected %q in: %s", test.args, res.status, test.want, res.stderr)
+		}
+	}
+}
+
+func TestQuietMissing(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "A=1\nE=\n"})
+	for _, test := range []struct {
+		flags []string
+		names []string
+		log   string
+	}{
+		{nil, []string{"A", "NONE", "E"}, "Variable not set by dotenv: NONE"},
+		{[]string{"--quiet-missing"}, []string{"A", "NONE", "E"}, ""},
+		{[]string{"--quiet-missing"}, []string{"A", "E"}, ""},
+	} {
+		args := append(append(append([]string{"-u", "-p"}, test.flags...), "-f", "a.env"), test.names...)
+		res := run(t, dir, args...)
+		// either way, missing names are skipped
+		if res.status != 0 || res.stdout != "1\n\n" {
+			t.Errorf("%q: exited %d: got %q", args, res.status, res.stdout)
+		}
+		if test.log == "" && res.stderr != "" || !strings.Contains(res.stderr, test.log) {
+			t.Errorf("%q: got %q, want %q", args, res.stderr, test.log)
+		}
+	}
+}
+
+func TestFailMissing(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "A=1\nE=\n"})
+	for _, test := range []struct {
+		flags  []string
+		names  []string
+		status int
+		logged bool
+	}{
+		{[]string{"--fail-missing"}, []string{"A", "NONE"}, 1, true},
+		{[]string{"--fail-missing", "--quiet-missing"}, []string{"A", "NONE"}, 1, false},
+		// (empty is set)
+		{[]string{"--fail-missing"}, []string{"A", "E"}, 0, false},
+		{nil, []string{"A", "NONE"}, 0, true},
+	} {
+		args := append(append(append([]string{"-u", "-p"}, test.flags...), "-f", "a.env"), test.names...)
+		res := run(t, dir, args...)
+		// the rest are printed regardless
+		if res.status != test.status || !strings.HasPrefix(res.stdout, "1\n") {
+			t.Errorf("%q: exited %d, want %d: got %q", args, res.status, test.status, res.stdout)
+		}
+		if logged := strings.Contains(res.stderr, "Variable not set by dotenv: NONE"); logged != test.logged {
+			t.Errorf("%q: logged %v, want %v: %s", args, logged, test.logged, res.stderr)
+		}
+	}
+}
+
+func TestGzippedSources(t *testing.T) {
+	gz := func(s string) []byte {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write([]byte(s))
+		w.Close()
+		return buf.Bytes()
+	}
+	for _, test := range []struct {
+		kind    sourcetype
+		content string
+	}{
+		{file, "A=1\n"},
+		{laxfile, "export A='1'\n"},
+		{shell, "export A=\"1\"\n"},
+		{inifile, "A = 1\n"},
+		{jsonfile, `{"A":1}`},
+		{yamlfile, "A: 1\n"},
+		{tomlfile, "A = \"1\"\n"},
+		{base64file, "QQ== MQ==\n"},
+	} {
+		src := varsource{kind: test.kind, data: "memory", content: gz(test.content)}
+		vars, err := parsesource(src)
+		if got := assignments(vars); err != nil || !reflect.DeepEqual(got, []string{"A=1"}) {
+			t.Errorf("%s: got %q (%v)", test.kind, got, err)
+		}
+	}
+	dir := fixtures(t, map[string]string{
+		// (by the contents, not the name)
+		"a.env":   string(gz("A=1\n")),
+		"bad.env": "\x1f\x8bnot really",
+	})
+	if got := output(t, dir, "-u", "-o", "-f", "a.env"); got != "A=1\n" {
+		t.Errorf("got %q", got)
+	}
+	if res := run(t, dir, "-u", "-o", "-f", "bad.env"); res.status != 1 || !strings.Contains(res.stderr, "Failed to decompress") {
+		t.Errorf("bad.env: exited %d: %s", res.status, res.stderr)
+	}
+}
+
+func TestDecodeBase64(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env":   "A=!base64:aGVsbG8=\nB=plain\nE=!base64:\nR=!base64:${P}\nP=aGk=\nM=b64:aGk=\n",
+		"bad.env": "C=!base64:!!bad\n",
+	})
+	for _, test := range []struct {
+		flags []string
+		want  map[string]string
+	}{
+		{nil, map[string]string{"A": "!base64:aGVsbG8=", "B": "plain", "E": "!base64:", "R": "!base64:aGk=", "P": "aGk=", "M": "b64:aGk="}},
+		// (after interpolation)
+		{[]string{"--decode-base64"}, map[string]string{"A": "hello", "B": "plain", "E": "", "R": "hi", "P": "aGk=", "M": "b64:aGk="}},
+		{[]string{"--base64-marker", "b64:"}, map[string]string{"A": "!base64:aGVsbG8=", "B": "plain", "E": "!base64:", "R": "!base64:aGk=", "P": "aGk=", "M": "hi"}},
+	} {
+		args := append(test.flags, "-f", "a.env")
+		if got := dumpjson(t, dir, args...); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.flags, got, test.want)
+		}
+	}
+	res := run(t, dir, "-u", "-o", "--decode-base64", "-f", "bad.env")
+	if res.status != 1 || !strings.Contains(res.stderr, "C: invalid base64") {
+		t.Errorf("invalid: exited %d: %s", res.status, res.stderr)
+	}
+}
+
+func TestUndefinedRefs(t *testing.T) {
+	t.Setenv("DOTENV_TEST_AMBIENT", "ambient")
+	dir := fixtures(t, map[string]string{
+		"a.env":  "A=${B}/${C}\nB=b\nD=$E ${F:-x}\nR=${DOTENV_TEST_AMBIENT}\n",
+		"c.env":  "C=c\n",
+		"ok.env": "A=${B}\nB=b\n",
+		"q.env":  "A=${B}\nQ='${SQ}'\nD=${E}\n",
+	})
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-u", "-f", "a.env"}, "C\nE\nF\n"},
+		// only values that would be interpolated count
+		{[]string{"-u", "-f", "q.env"}, "B\nE\n"},
+		{[]string{"-u", "--no-sub", "-f", "q.env"}, ""},
+		{[]string{"-u", "--force-sub", "-f", "q.env"}, "B\nE\nSQ\n"},
+		{[]string{"-u", "--interp-only", "A", "-f", "q.env"}, "B\n"},
+		{[]string{"-u", "-x", "-f", "q.env"}, ""},
+		{[]string{"-u", "-x", "--sub", "-f", "q.env"}, "B\nE\nSQ\n"},
+		// the environment counts, unless it's out of scope for interpolation
+		{[]string{"-u", "--interp-no-osenv", "-f", "a.env"}, "C\nDOTENV_TEST_AMBIENT\nE\nF\n"},
+		{[]string{"-u", "-f", "a.env", "-f", "c.env"}, "E\nF\n"},
+		{[]string{"-u", "C=1", "-f", "a.env"}, "E\nF\n"},
+		{[]string{"-u", "--names-only-missing", "-f", "ok.env"}, ""},
+	} {
+		args := append([]string{"--undefined-refs"}, test.args...)
+		if got := output(t, dir, args...); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestJSONOutputOrder(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "Z=1\nA=\"q\\\"<&>\"\nM=3\n"})
+	// (values are escaped the same way, in either order)
+	a := `"A": "q\"\u003c\u0026\u003e"`
+	for _, test := range []struct {
+		flags []string
+		want  string
+	}{
+		{nil, "{\n  " + a + ",\n  \"M\": \"3\",\n  \"Z\": \"1\"\n}\n"},
+		{[]string{"--no-sort"}, "{\n  \"Z\": \"1\",\n  " + a + ",\n  \"M\": \"3\"\n}\n"},
+		{[]string{"--no-sort", "--json-envelope"},
+			"{\n  \"sorted\": false,\n  \"count\": 3,\n  \"vars\": {\n    \"Z\": \"1\",\n    " + a + ",\n    \"M\": \"3\"\n  }\n}\n"},
+	} {
+		args := append(append([]string{"-u", "-o", "-j"}, test.flags...), "-f", "a.env")
+		if got := output(t, dir, args...); got != test.want {
+			t.Errorf("%q: got %q, want %q", test.flags, got, test.want)
+		}
+	}
+}
+
+func TestJSONTyped(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.json": `{"N":5,"F":1.50,"B":true,"S":"5","O":{"X":false},"BIG":12345678901234567890}`,
+		"a.yaml": "P: 5\nB: yes\nS: \"5\"\n",
+		"a.toml": "N = 5\nB = false\nS = \"5\"\n",
+		"a.env":  "E=5\nR=${N}\n",
+	})
+	for _, test := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--json-file", "a.json", "-f", "a.env"},
+			`{"B":true,"BIG":12345678901234567890,"E":"5","F":1.5,"N":5,"O_X":false,"R":"5","S":"5"}`},
+		{[]string{"-y", "-f", "a.yaml"}, `{"B":true,"P":5,"S":"5"}`},
+		{[]string{"--toml", "-f", "a.toml"}, `{"B":false,"N":5,"S":"5"}`},
+		// (a higher-priority source's string wins)
+		{[]string{"N=five", "--json-file", "a.json"},
+			`{"B":true,"BIG":12345678901234567890,"F":1.5,"N":"five","O_X":false,"S":"5"}`},
+	} {
+		args := append([]string{"-u", "-j", "--json-typed"}, test.args...)
+		var got bytes.Buffer
+		if err := json.Compact(&got, []byte(output(t, dir, args...))); err != nil {
+			t.Fatal(err)
+		}
+		if got.String() != test.want {
+			t.Errorf("%q: got %s, want %s", test.args, got.String(), test.want)
+		}
+	}
+	// other output is the same either way
+	want := "B=true\nBIG=12345678901234567890\nF=1.5\nN=5\nO_X=false\nS=5\n"
+	if got := output(t, dir, "-u", "-o", "--json-typed", "--json-file", "a.json"); got != want {
+		t.Errorf("text: got %q, want %q", got, want)
+	}
+}
+
+func TestStrictEscapes(t *testing.T) {
+	for _, test := range []struct {
+		val, want string
+	}{
+		{`a\tb\\c`, "a\tb\\c"},
+		{`line1\nline2\r`, "line1\nline2\r"},
+		{`say \"hi\"`, `say "hi"`},
+		// unknown escapes are left as-is
+		{`\q\x41\0\$`, `\q\x41\0\$`},
+		{`trailing\`, `trailing\`},
+	} {
+		dir := fixtures(t, map[string]string{"a.env": "E=" + test.val + "\n"})
+		if got := dumpjson(t, dir, "-x", "-f", "a.env")["E"]; got != test.val {
+			t.Errorf("%q: without --expand-escapes: got %q", test.val, got)
+		}
+		if got := dumpjson(t, dir, "-x", "--expand-escapes", "-f", "a.env")["E"]; got != test.want {
+			t.Errorf("%q: got %q, want %q", test.val, got, test.want)
+		}
+	}
+}
+
+func TestTrim(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "A=  x y  \nB=\t tab\t\nC=   \nD=\"  quoted  \"  \n"})
+	for _, test := range []struct {
+		trim bool
+		want map[string]string
+	}{
+		{false, map[string]string{"A": "  x y  ", "B": "\t tab\t", "C": "   ", "D": `"  quoted  "  `}},
+		// quotes are part of a strict value, so only the outside is trimmed
+		{true, map[string]string{"A": "x y", "B": "tab", "C": "", "D": `"  quoted  "`}},
+	} {
+		args := []string{"-x", "-f", "a.env"}
+		if test.trim {
+			args = append([]string{"--trim"}, args...)
+		}
+		if got := dumpjson(t, dir, args...); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", args, got, test.want)
+		}
+	}
+}
+
+func TestWarnDuplicates(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env": "PORT=1\nOTHER=x\nPORT=2\nPORT=3\n",
+		"b.env": "OTHER=y\n",
+	})
+	warning := "PORT is set on lines 1, 3, 4 (the last one wins)"
+	for _, test := range []struct {
+		flags []string
+		warns int
+	}{
+		{nil, 0},
+		{[]string{"--warn-duplicates"}, 1},
+		{[]string{"--warn-duplicates", "-x"}, 1},
+	} {
+		// (only names repeated within one source count)
+		args := append(append([]string{"-u", "-o"}, test.flags...), "-f", "a.env", "-f", "b.env")
+		res := run(t, dir, args...)
+		if res.status != 0 || res.stdout != "OTHER=y\nPORT=3\n" {
+			t.Errorf("%q: exited %d: got %q", test.flags, res.status, res.stdout)
+		}
+		if strings.Count(res.stderr, warning) != test.warns || strings.Count(res.stderr, "\n") != test.warns {
+			t.Errorf("%q: expected %d of %q, got: %s", test.flags, test.warns, warning, res.stderr)
+		}
+	}
+}
+
+func TestPrintSource(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env": "A=1\nB=2\nC=3\n",
+		"b.env": "C=4\nD=5\n",
+	})
+	// each name reports the source of the value that's used
+	for _, test := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"-o"}, []string{"A=1 # from a.env", "B=raw # from raw", "C=3 # from a.env", "D=5 # from b.env"}},
+		{[]string{"-n"}, []string{"A # from a.env", "B # from raw", "C # from a.env", "D # from b.env"}},
+		// values are printed as-is, to be used by scripts
+		{[]string{"-p", "B", "D"}, []string{"raw", "5"}},
+		{[]string{"-j"}, []string{"{", `  "A": "1",`, `  "B": "raw",`, `  "C": "3",`, `  "D": "5"`, "}"}},
+	} {
+		args := append([]string{"-u", "--print-source", "a.env", "b.env", "B=raw"}, test.args...)
+		if got := lines(output(t, dir, args...)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+	}
+	if got := output(t, dir, "-u", "-o", "a.env"); got != "A=1\nB=2\nC=3\n" {
+		t.Errorf("without --print-source: got %q", got)
+	}
+}
+
+func TestTombstonePriority(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"over.env": "X=1\n",
+		"base.env": "!X\nY=2\n",
+		"drop.env": "!Y\n",
+	})
+	for _, test := range []struct {
+		args []string
+		want []string
+	}{
+		// a later file wins over an earlier file's tombstone
+		{[]string{"-f", "base.env", "-f", "over.env"}, []string{"X=1", "Y=2"}},
+		// and so does an assignment
+		{[]string{"X=raw", "-f", "base.env"}, []string{"X=raw", "Y=2"}},
+		// but a tombstone in a later file wins over an earlier file
+		{[]string{"-f", "base.env", "-f", "drop.env"}, []string{}},
+		{[]string{"-f", "over.env", "-f", "base.env"}, []string{"Y=2"}},
+	} {
+		args := append([]string{"-u", "-o"}, test.args...)
+		got := []string{}
+		if out := output(t, dir, args...); out != "" {
+			got = lines(out)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestNamedSources(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"base.env":    "A=base\nB=b\n",
+		"local.env":   "A=${source:base:A}-local\n",
+		"unknown.env": "A=${source:nope:A}\n",
+	})
+	// the overriding file is read first, but can still see the base
+	got := lines(output(t, dir, "-u", "-o", "--name", "base", "-f", "base.env", "-f", "local.env"))
+	if want := []string{"A=base-local", "B=b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	res := run(t, dir, "-u", "-o", "--name", "base", "-f", "base.env", "-f", "unknown.env")
+	if res.status == 0 || !strings.Contains(res.stderr, `No source is named "nope"`) {
+		t.Errorf("unknown source: exited %d: %s", res.status, res.stderr)
+	}
+}
+
+func TestExportDeferInterp(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "A=a\nB=${A}/b\nC=it's\nD='${A} $$'\n"})
+	for _, test := range []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"export A='a'", "export B='a/b'", `export C='it'\''s'`, "export D='${A} $$'"}},
+		// values that aren't interpolated stay literal
+		{[]string{"--defer-interp"}, []string{`export A="a"`, `export B="${A}/b"`, `export C="it's"`, "export D='${A} $$'"}},
+		{[]string{"--defer-interp", "--no-sub"}, []string{"export A='a'", "export B='${A}/b'", `export C='it'\''s'`, "export D='${A} $$'"}},
+		{[]string{"--defer-interp", "--interp-only", "B"}, []string{"export A='a'", `export B="${A}/b"`, `export C='it'\''s'`, "export D='${A} $$'"}},
+	} {
+		args := append(append([]string{"-u", "-e"}, test.args...), "-f", "a.env")
+		if got := lines(output(t, dir, args...)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+		// and a shell sees what dotenv would have set
+		args[1] = "--dump-shell-script"
+		script := output(t, dir, args...)
+		want := "a|a/b|it's|${A} $$|"
+		if len(test.args) > 1 && test.args[1] == "--no-sub" {
+			want = "a|${A}/b|it's|${A} $$|"
+		}
+		if got := sourced(t, dir, script, "A", "B", "C", "D"); got != want {
+			t.Errorf("%q: got %q, want %q from:\n%s", args, got, want, script)
+		}
+	}
+}
+
+func TestCascade(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		".env.test.local": "A=env.test.local\n",
+		".env.local":      "A=env.local\nB=env.local\n",
+		".env.test":       "A=env.test\nB=env.test\nC=env.test\n",
+		".env":            "A=env\nB=env\nC=env\nD=env\n",
+	})
+	got := lines(output(t, dir, "-u", "-o", "--cascade", "test"))
+	want := []string{"A=env.test.local", "B=env.local", "C=env.test", "D=env"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// missing files are skipped
+	if got := lines(output(t, dir, "-u", "-o", "--cascade", "other")); !reflect.DeepEqual(got, []string{"A=env.local", "B=env.local", "C=env", "D=env"}) {
+		t.Errorf("--cascade other: got %q", got)
+	}
+}
+
+func TestDuplicatesInSource(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env": "PORT=1\nURL=http://host:${PORT}\nPORT=2\nOTHER=x\nPORT=3\nGONE=x\n!GONE\n",
+	})
+	// the last definition wins, and is the only one other values can see
+	for _, test := range []struct {
+		flags []string
+		want  string
+	}{
+		{nil, "OTHER=x\nPORT=3\nURL=http://host:3\n"},
+		// (so here, it comes too late)
+		{[]string{"--single-pass-interp"}, "OTHER=x\nPORT=3\nURL=http://host:\n"},
+	} {
+		args := append(append([]string{"-u", "-o", "--warn-duplicates"}, test.flags...), "-f", "a.env")
+		res := run(t, dir, args...)
+		if res.status != 0 || res.stdout != test.want {
+			t.Errorf("%q: exited %d: got %q, want %q", test.flags, res.status, res.stdout, test.want)
+		}
+		warning := "PORT is set on lines 1, 3, 5 (the last one wins)"
+		if strings.Count(res.stderr, warning) != 1 || len(lines(res.stderr)) != 1 {
+			t.Errorf("%q: expected one warning, %q, got: %s", test.flags, warning, res.stderr)
+		}
+	}
+	// the library agrees
+	env, err := Read(filepath.Join(dir, "a.env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"OTHER": "x", "PORT": "3", "URL": "http://host:3"}; !reflect.DeepEqual(env, want) {
+		t.Errorf("Read: got %q, want %q", env, want)
+	}
+}
+
+func TestNamedSourceReadOnce(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs sh")
+	}
+	dir := t.TempDir()
+	got := lines(output(t, dir, "-u", "-o", "--allow-cmd", "--name", "gen", "cmd:sh -c 'echo run >> runs; echo A=1'"))
+	if want := []string{"A=1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if runs, _ := ioutil.ReadFile(filepath.Join(dir, "runs")); string(runs) != "run\n" {
+		t.Errorf("expected the command to run once, got %q", runs)
+	}
+}
+
+func TestWarningSummaryBeforeFailure(t *testing.T) {
+	dir := fixtures(t, map[string]string{
+		"a.env": "A=1\nA=2\n",
+		"b.env": "B=${B:?B is required}\n",
+	})
+	for _, args := range [][]string{
+		{"-f", "missing.env", "-f", "a.env"},
+		{"-f", "a.env", "--require", "B"},
+		{"-f", "b.env", "-f", "a.env"},
+	} {
+		res := run(t, dir, append([]string{"-u", "-o", "--warn-summary", "--warn-duplicates"}, args...)...)
+		if res.status == 0 || !strings.Contains(res.stderr, "Warnings for a.env:") || !strings.Contains(res.stderr, "A is set on lines 1, 2") {
+			t.Errorf("%q: exited %d: %s", args, res.status, res.stderr)
+		}
+	}
+}
+
+func TestOptionalSourceErrors(t *testing.T) {
+	dir := fixtures(t, map[string]string{"a.env": "A=1\n", "bad.env": "OK=1\nB=\"unclosed\n"})
+	for _, test := range []struct {
+		flags  []string
+		stderr []string
+	}{
+		{nil, []string{"Error parsing bad.env: bad.env:2: Unclosed double-quoted value for B"}},
+		{[]string{"--warn-summary"}, []string{"Warnings for bad.env:", "  Error parsing bad.env: bad.env:2: Unclosed double-quoted value for B"}},
+		{[]string{"-q"}, nil},
+	} {
+		// (what was read before the error is kept, by either parser)
+		for _, kind := range [][]string{{"-x"}, nil} {
+			args := append(append(append([]string{"-u", "-o"}, kind...), test.flags...), "--optional", "bad.env", "-f", "a.env")
+			if res := run(t, dir, args...); res.status != 0 || res.stdout != "A=1\nOK=1\n" {
+				t.Errorf("%q %q: exited %d: got %q", kind, test.flags, res.status, res.stdout)
+			}
+		}
+		args := append(append([]string{"-u", "-o", "-x"}, test.flags...), "--optional", "bad.env", "-f", "a.env")
+		res := run(t, dir, args...)
+		got := []string{}
+		for _, line := range lines(res.stderr) {
+			if line != "" {
+				// (strip the log timestamp)
+				got = append(got, strings.SplitN(line, " ", 3)[2])
+			}
+		}
+		if len(got) != len(test.stderr) || len(got) > 0 && !reflect.DeepEqual(got, test.stderr) {
+			t.Errorf("%q: got %q, want %q", test.flags, got, test.stderr)
+		}
+	}
+}
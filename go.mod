@@ -0,0 +1,12 @@
+module github.com/benizi/dotenv
+
+go 1.18
+
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/mattn/go-shellwords v1.0.15
+	golang.org/x/sys v0.15.0
+	golang.org/x/term v0.15.0
+	golang.org/x/text v0.14.0
+	gopkg.in/yaml.v2 v2.4.0
+)
@@ -0,0 +1,78 @@
+package dotenv
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Read another process's environment from its `KERN_PROCARGS2` block:
+//
+//	argc (int32), exec path, NUL padding, argv[0..argc], env..., ""
+//
+// The kernel only allows this for the current user's processes (or root's),
+// so there's no `sudo` fallback like on Linux.
+func readenv(ctx context.Context, p uint64) ([]envvar, error) {
+	buf, err := unix.SysctlRaw("kern.procargs2", int(p))
+	if err != nil {
+		return nil, fmt.Errorf("sysctl kern.procargs2: %w (only your own processes are readable, unless run as root)", err)
+	}
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("sysctl kern.procargs2: short result")
+	}
+	argc := int(binary.LittleEndian.Uint32(buf))
+	rest := buf[4:]
+	end := bytes.IndexByte(rest, 0)
+	if end < 0 {
+		return []envvar{}, nil
+	}
+	rest = bytes.TrimLeft(rest[end:], "\x00")
+	for ; argc > 0; argc-- {
+		end := bytes.IndexByte(rest, 0)
+		if end < 0 {
+			return []envvar{}, nil
+		}
+		rest = rest[end+1:]
+	}
+	env := []string{}
+	for {
+		end := bytes.IndexByte(rest, 0)
+		if end <= 0 {
+			break
+		}
+		env = append(env, string(rest[:end]))
+		rest = rest[end+1:]
+	}
+	return parseassignments(strings.Join(env, "\x00"), "\x00"), nil
+}
+
+// Map each PID to its children, according to `ps`
+func childpids(ctx context.Context) (map[uint64][]uint64, error) {
+	out, err := exec.CommandContext(ctx, "ps", "-A", "-o", "pid=", "-o", "ppid=").Output()
+	if err != nil {
+		return nil, err
+	}
+	children := map[uint64][]uint64{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		pid, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		ppid, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], pid)
+	}
+	return children, nil
+}
@@ -0,0 +1,84 @@
+package dotenv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func readenv(ctx context.Context, p uint64) ([]envvar, error) {
+	proc, err := os.Stat("/proc")
+	if err != nil {
+		return nil, err
+	}
+	if !proc.IsDir() {
+		return nil, fmt.Errorf("/proc is not a directory")
+	}
+	environ := fmt.Sprintf("/proc/%d/environ", p)
+	data, err := ioutil.ReadFile(environ)
+	if err != nil {
+		if !os.IsPermission(err) {
+			return nil, err
+		}
+		ret := explainpermission(err)
+		if !sudoenv {
+			return nil, ret
+		}
+		data, err = exec.CommandContext(ctx, "sudo", "cat", environ).Output()
+		if err != nil {
+			return nil, ret
+		}
+	}
+	return parseassignments(string(data), "\x00"), nil
+}
+
+// Permission errors for other users' processes are expected, but hardened
+// systems (`kernel.yama.ptrace_scope`) can also deny access to your own
+func explainpermission(err error) error {
+	scope, serr := ioutil.ReadFile("/proc/sys/kernel/yama/ptrace_scope")
+	if serr != nil || strings.TrimSpace(string(scope)) == "0" {
+		return err
+	}
+	return fmt.Errorf("%w (kernel.yama.ptrace_scope = %s may be restricting access)", err, strings.TrimSpace(string(scope)))
+}
+
+// Map each PID to its children, from the parent PIDs in `/proc/*/stat`.
+// Processes that exit while this runs are skipped.
+func childpids(ctx context.Context) (map[uint64][]uint64, error) {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return nil, err
+	}
+	children := map[uint64][]uint64{}
+	for _, stat := range stats {
+		data, err := ioutil.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+		// `PID (COMM) STATE PPID ...`, where COMM can contain anything
+		end := bytes.LastIndexByte(data, ')')
+		if end < 0 {
+			continue
+		}
+		fields := strings.Fields(string(data[end+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		pid, err := strconv.ParseUint(filepath.Base(filepath.Dir(stat)), 10, 32)
+		if err != nil {
+			continue
+		}
+		ppid, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], pid)
+	}
+	return children, nil
+}
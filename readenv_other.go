@@ -0,0 +1,18 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package dotenv
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+func readenv(ctx context.Context, p uint64) ([]envvar, error) {
+	return nil, fmt.Errorf("reading other processes' environments isn't supported on %s", runtime.GOOS)
+}
+
+func childpids(ctx context.Context) (map[uint64][]uint64, error) {
+	return nil, fmt.Errorf("listing processes isn't supported on %s", runtime.GOOS)
+}